@@ -23,14 +23,16 @@ import (
 	neturl "net/url"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
 	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/persist"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/x/bsonx"
 )
 
 const defaultTimeout time.Duration = 30 * time.Second
@@ -38,6 +40,7 @@ const defaultTimeout time.Duration = 30 * time.Second
 // CasbinRule represents a rule in Casbin.
 type CasbinRule struct {
 	ID    interface{} `bson:"_id,omitempty"`
+	Sec   string      `bson:"sec,omitempty"`
 	PType string      `bson:"ptype"`
 	V0    string      `bson:"v0"`
 	V1    string      `bson:"v1"`
@@ -45,16 +48,50 @@ type CasbinRule struct {
 	V3    string      `bson:"v3"`
 	V4    string      `bson:"v4"`
 	V5    string      `bson:"v5"`
+	// Arity is the number of values of the rule, which tells empty values
+	// from absent ones. It is 0 for rules stored without it, whose trailing
+	// empty values are dropped on load. It is part of the unique index, so
+	// rules differing only by trailing empty values are stored together.
+	Arity int `bson:"arity,omitempty"`
+	// Version is incremented on every update of the rule. Rules that were
+	// never updated have version 0.
+	Version int64 `bson:"version,omitempty"`
 }
 
 // adapter represents the MongoDB adapter for policy storage.
 type adapter struct {
 	clientOption *options.ClientOptions
 	client       *mongo.Client
-	collection   *mongo.Collection
+	database     store.Database
+	collection   store.Collection
+	collections  []store.Collection
+	names        []string
+	indexes      map[string][]mongo.IndexModel
+	routes       map[string]store.Collection
+	layout       map[string]CollectionSpec
 	timeout      time.Duration
 	updatable    bool
 	filtered     bool
+	diffSave     bool
+	validation   model.Model
+	cipher       *fieldCipher
+	cache        *PolicyCache
+	slices       []*policySlice
+	loadedInto   map[string]int
+	statsTop     int
+	statsValues  int
+	locker       *locker
+	backupGzip   bool
+	backupLevel  int
+	skipDups     bool
+	nonTxRestore bool
+	fields       map[string]string
+	named        map[string]map[string]string
+	ruleIDs      bool
+	onSkipped    func(skipped []CasbinRule)
+
+	statusMu sync.Mutex
+	status   ConnectionStatus
 }
 
 // finalizer is the destructor for adapter.
@@ -63,8 +100,10 @@ func finalizer(a *adapter) {
 }
 
 // NewAdapter is the constructor for Adapter. If database name is not provided
-// in the Mongo URL, 'casbin' will be used as database name.
-func NewAdapter(url string, timeout ...interface{}) (persist.Adapter, error) {
+// in the Mongo URL, 'casbin' will be used as database name. The optional
+// arguments are a time.Duration timeout for database operations and any number
+// of Option values.
+func NewAdapter(url string, opts ...interface{}) (persist.Adapter, error) {
 	if !strings.HasPrefix(url, "mongodb+srv://") && !strings.HasPrefix(url, "mongodb://") {
 		url = fmt.Sprint("mongodb://" + url)
 	}
@@ -82,27 +121,20 @@ func NewAdapter(url string, timeout ...interface{}) (persist.Adapter, error) {
 		databaseName = "casbin_rule"
 	}
 
-	return NewAdapterWithClientOption(clientOption, databaseName, timeout...)
+	return NewAdapterWithClientOption(clientOption, databaseName, opts...)
 }
 
 // NewAdapterWithClientOption is an alternative constructor for Adapter
 // that does the same as NewAdapter, but uses mongo.ClientOption instead of a Mongo URL
-func NewAdapterWithClientOption(clientOption *options.ClientOptions, databaseName string, timeout ...interface{}) (persist.Adapter, error) {
-	a := &adapter{
-		clientOption: clientOption,
-	}
-	a.filtered = false
-
-	if len(timeout) == 1 {
-		a.timeout = timeout[0].(time.Duration)
-	} else if len(timeout) > 1 {
-		return nil, errors.New("too many arguments")
-	} else {
-		a.timeout = defaultTimeout
+func NewAdapterWithClientOption(clientOption *options.ClientOptions, databaseName string, opts ...interface{}) (persist.Adapter, error) {
+	a, err := newAdapter(opts...)
+	if err != nil {
+		return nil, err
 	}
+	a.clientOption = clientOption
 
 	// Open the DB, create it if not existed.
-	err := a.open(databaseName)
+	err = a.open(databaseName)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +145,56 @@ func NewAdapterWithClientOption(clientOption *options.ClientOptions, databaseNam
 	return a, nil
 }
 
+// NewAdapterWithDatabase is an alternative constructor for Adapter that stores
+// the policy in the given database instead of connecting to MongoDB. It is
+// intended for storage backends such as the in-memory one provided by the
+// memory package.
+func NewAdapterWithDatabase(db store.Database, opts ...interface{}) (persist.Adapter, error) {
+	a, err := newAdapter(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.init(db); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// newAdapter creates an adapter that is not yet bound to a database, applying
+// the optional timeout and options.
+func newAdapter(opts ...interface{}) (*adapter, error) {
+	a := &adapter{}
+	a.filtered = false
+	a.timeout = defaultTimeout
+	a.statsTop = defaultStatsTop
+	a.statsValues = defaultStatsValues
+
+	hasTimeout := false
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case time.Duration:
+			if hasTimeout {
+				return nil, errors.New("too many arguments")
+			}
+			a.timeout = o
+			hasTimeout = true
+		case Option:
+			if err := o(a); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported argument of type %T", opt)
+		}
+	}
+	if err := a.checkFieldNames(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
 // NewFilteredAdapter is the constructor for FilteredAdapter.
 // Casbin will not automatically call LoadPolicy() for a filtered adapter.
 func NewFilteredAdapter(url string) (persist.FilteredAdapter, error) {
@@ -128,8 +210,21 @@ func NewFilteredAdapter(url string) (persist.FilteredAdapter, error) {
 // NewUpdatableAdapter is the constructor for an UpdatableAdapter. It is the standard Adapter, with
 // ability to update a single policy. If database name is not provided in the Mongo URL, 'casbin' will
 // be used as database name.
-func NewUpdatableAdapter(url string, timeout ...interface{}) (persist.UpdatableAdapter, error) {
-	a, err := NewAdapter(url, timeout...)
+func NewUpdatableAdapter(url string, opts ...interface{}) (persist.UpdatableAdapter, error) {
+	a, err := NewAdapter(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	a.(*adapter).updatable = true
+
+	return a.(*adapter), nil
+}
+
+// NewUpdatableAdapterWithDatabase is an alternative constructor for
+// UpdatableAdapter that does the same as NewUpdatableAdapter, but stores the
+// policy in db, e.g. the in-memory database of the memory package.
+func NewUpdatableAdapterWithDatabase(db store.Database, opts ...interface{}) (persist.UpdatableAdapter, error) {
+	a, err := NewAdapterWithDatabase(db, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -140,8 +235,8 @@ func NewUpdatableAdapter(url string, timeout ...interface{}) (persist.UpdatableA
 
 // NewUpdatableAdapterWithClientOption is an alternative constructor for UpdatableAdapter
 // that does the same as NewUpdatableAdapter, but uses mongo.ClientOption instead of a Mongo URL
-func NewUpdatableAdapterWithClientOption(clientOption *options.ClientOptions, databaseName string, timeout ...interface{}) (persist.UpdatableAdapter, error) {
-	a, err := NewAdapterWithClientOption(clientOption, databaseName, timeout...)
+func NewUpdatableAdapterWithClientOption(clientOption *options.ClientOptions, databaseName string, opts ...interface{}) (persist.UpdatableAdapter, error) {
+	a, err := NewAdapterWithClientOption(clientOption, databaseName, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -159,68 +254,138 @@ func (a *adapter) open(databaseName string) error {
 		return err
 	}
 
-	db := client.Database(databaseName)
-	collection := db.Collection("casbin_rule")
-
 	a.client = client
-	a.collection = collection
 
-	indexes := []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
-	keysDoc := bsonx.Doc{}
+	return a.init(store.NewMongoDatabase(client.Database(databaseName)))
+}
 
-	for _, k := range indexes {
-		keysDoc = keysDoc.Append(k, bsonx.Int32(1))
-	}
+// init binds the adapter to the rule collections of db and ensures their
+// indexes.
+func (a *adapter) init(db store.Database) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	defer cancel()
 
-	if _, err = collection.Indexes().CreateOne(
-		context.Background(),
-		mongo.IndexModel{
-			Keys:    keysDoc,
-			Options: options.Index().SetUnique(true),
-		},
-	); err != nil {
+	a.database = db
+	if err := a.initCollections(ctx, db); err != nil {
 		return err
 	}
 
+	if a.locker != nil {
+		a.locker.coll = db.Collection(a.locker.collection)
+		a.locker.name = a.names[0]
+	}
+
+	if a.cache != nil {
+		return a.cache.watch(a.collections)
+	}
+
 	return nil
 }
 
 func (a *adapter) close() {
 	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
 	defer cancel()
-	a.client.Disconnect(ctx)
+	if a.client != nil {
+		a.client.Disconnect(ctx)
+	}
 }
 
-func (a *adapter) dropTable() error {
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
+// section returns the section of a stored rule. Rules written before the
+// section was persisted have none, so it is inferred from the ptype.
+func section(line CasbinRule) string {
+	if line.Sec != "" {
+		return line.Sec
+	}
+	return legacySection(line.PType)
+}
 
-	err := a.collection.Drop(ctx)
-	if err != nil {
-		return err
+// legacySection infers the section of a ptype from its first letter.
+func legacySection(ptype string) string {
+	if ptype == "" {
+		return ""
 	}
-	return nil
+	return ptype[:1]
+}
+
+// sectionSelector returns the selector value matching rules of sec. Rules
+// without a stored section match too if their ptype implies sec.
+func sectionSelector(sec string, ptype string) interface{} {
+	if legacySection(ptype) == sec {
+		return bson.M{"$in": bson.A{sec, nil}}
+	}
+	return sec
+}
+
+// sectionFilter matches the rules of sec, including rules without a
+// stored section whose ptype implies sec.
+func sectionFilter(sec string) bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "sec", Value: sec}},
+		bson.D{
+			{Key: "sec", Value: nil},
+			{Key: "ptype", Value: primitive.Regex{Pattern: "^" + sec}},
+		},
+	}}}
 }
 
-func loadPolicyLine(line CasbinRule, model model.Model) {
-	var p = []string{line.PType,
-		line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
-	var lineText string
-	if line.V5 != "" {
-		lineText = strings.Join(p, ", ")
-	} else if line.V4 != "" {
-		lineText = strings.Join(p[:6], ", ")
-	} else if line.V3 != "" {
-		lineText = strings.Join(p[:5], ", ")
-	} else if line.V2 != "" {
-		lineText = strings.Join(p[:4], ", ")
-	} else if line.V1 != "" {
-		lineText = strings.Join(p[:3], ", ")
-	} else if line.V0 != "" {
-		lineText = strings.Join(p[:2], ", ")
+// ruleFilter returns the selector matching exactly the stored rule line.
+func ruleFilter(line CasbinRule) bson.D {
+	return bson.D{
+		{Key: "sec", Value: sectionSelector(line.Sec, line.PType)},
+		{Key: "ptype", Value: line.PType},
+		{Key: "v0", Value: line.V0},
+		{Key: "v1", Value: line.V1},
+		{Key: "v2", Value: line.V2},
+		{Key: "v3", Value: line.V3},
+		{Key: "v4", Value: line.V4},
+		{Key: "v5", Value: line.V5},
+		{Key: "arity", Value: aritySelector(line.Arity)},
 	}
+}
 
-	persist.LoadPolicyLine(lineText, model)
+// aritySelector returns the selector value matching arity. Rules stored
+// without their arity match any arity.
+func aritySelector(arity int) interface{} {
+	return bson.M{"$in": bson.A{arity, nil}}
+}
+
+// loadPolicyLine adds the values of a stored rule to the model as they are,
+// so that values containing commas or spaces aren't split or trimmed. Rules
+// without values, and rules already in the model, are skipped.
+func loadPolicyLine(line CasbinRule, m model.Model) error {
+	rule := ruleValues(line)
+	if len(rule) == 0 {
+		return nil
+	}
+
+	sec := section(line)
+	ast, ok := m[sec][line.PType]
+	if !ok {
+		return fmt.Errorf("ptype %q of section %q is not defined in the model", line.PType, sec)
+	}
+	key := strings.Join(rule, model.DefaultSep)
+	if _, ok := ast.PolicyMap[key]; ok {
+		return nil
+	}
+	ast.Policy = append(ast.Policy, rule)
+	ast.PolicyMap[key] = len(ast.Policy) - 1
+
+	return nil
+}
+
+// ruleValues returns the values of a stored rule. Rules stored without their
+// arity have their trailing empty values dropped.
+func ruleValues(line CasbinRule) []string {
+	values := []string{line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
+	n := line.Arity
+	if n == 0 {
+		for n = len(values); n > 0 && values[n-1] == ""; n-- {
+		}
+	}
+	if n > len(values) {
+		n = len(values)
+	}
+	return values[:n]
 }
 
 // LoadPolicy loads policy from database.
@@ -229,33 +394,120 @@ func (a *adapter) LoadPolicy(model model.Model) error {
 }
 
 // LoadFilteredPolicy loads matching policy lines from database. If not nil,
-// the filter must be a valid MongoDB selector.
+// the filter must be a valid MongoDB selector. If the policy of model wasn't
+// cleared since the adapter last loaded into it, as when called by
+// Enforcer.LoadIncrementalFilteredPolicy, the matching rules are added to it
+// as by LoadIncrementalFilteredPolicy.
 func (a *adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
-	if filter == nil {
-		a.filtered = false
-		filter = bson.D{{}}
-	} else {
-		a.filtered = true
+	switch f := filter.(type) {
+	case incrementalFilter:
+		return a.LoadIncrementalFilteredPolicy(model, f.filter)
+	case loadedPolicy:
+		return a.movePolicy(model, f)
+	}
+	if filter != nil && a.loadedIntoPolicy(model) {
+		if !a.filtered {
+			// The whole policy is loaded, so it holds the rules of any
+			// filter and isn't restricted to filter.
+			return a.forEachLine(context.TODO(), filter, func(line CasbinRule) error {
+				return loadPolicyLine(line, model)
+			})
+		}
+		return a.LoadIncrementalFilteredPolicy(model, filter)
 	}
-	line := CasbinRule{}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
+	a.filtered = filter != nil
+	a.slices = nil
+	a.loadedInto = policyMap(model)
 
-	cursor, err := a.collection.Find(ctx, filter)
+	var slice *policySlice
+	if filter != nil {
+		var err error
+		if slice, err = newPolicySlice(filter); err != nil {
+			return err
+		}
+	}
+
+	err := a.forEachLine(context.TODO(), filter, func(line CasbinRule) error {
+		if slice != nil {
+			slice.add(line)
+		}
+		return loadPolicyLine(line, model)
+	})
 	if err != nil {
 		return err
 	}
 
-	for cursor.Next(ctx) {
-		err := cursor.Decode(&line)
+	if slice != nil {
+		a.slices = []*policySlice{slice}
+	}
+	return nil
+}
+
+// forEachLine calls fn with every decoded rule matching filter, which may be
+// nil to match all rules, reading them within the timeout of the adapter or
+// until ctx is done. The rules are served from the cache if possible.
+func (a *adapter) forEachLine(ctx context.Context, filter interface{}, fn func(line CasbinRule) error) error {
+	key, cacheable := a.cache.key(filter)
+	if filter == nil {
+		filter = bson.D{{}}
+	} else {
+		var err error
+		if filter, err = a.encryptFilter(filter); err != nil {
+			return err
+		}
+	}
+
+	var gen uint64
+	if cacheable {
+		var lines []CasbinRule
+		var ok bool
+		if lines, gen, ok = a.cache.get(key); ok {
+			for _, line := range lines {
+				if err := fn(line); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	var lines []CasbinRule
+	for _, coll := range a.collections {
+		cursor, err := coll.Find(ctx, filter)
 		if err != nil {
 			return err
 		}
-		loadPolicyLine(line, model)
+
+		for cursor.Next(ctx) {
+			line := CasbinRule{}
+			err := cursor.Decode(&line)
+			if err != nil {
+				return err
+			}
+			if line, err = a.cipher.decryptLine(line); err != nil {
+				return err
+			}
+			if err := fn(line); err != nil {
+				return err
+			}
+			if cacheable {
+				lines = append(lines, line)
+			}
+		}
+
+		if err := cursor.Close(ctx); err != nil {
+			return err
+		}
+	}
+	if cacheable {
+		a.cache.put(key, lines, gen)
 	}
 
-	return cursor.Close(ctx)
+	return nil
 }
 
 // IsFiltered returns true if the loaded policy has been filtered.
@@ -263,9 +515,11 @@ func (a *adapter) IsFiltered() bool {
 	return a.filtered
 }
 
-func savePolicyLine(ptype string, rule []string) CasbinRule {
+func savePolicyLine(sec string, ptype string, rule []string) CasbinRule {
 	line := CasbinRule{
+		Sec:   sec,
 		PType: ptype,
+		Arity: len(rule),
 	}
 
 	if len(rule) > 0 {
@@ -295,43 +549,131 @@ func (a *adapter) SavePolicy(model model.Model) error {
 	if a.filtered {
 		return errors.New("cannot save a filtered policy")
 	}
-	if err := a.dropTable(); err != nil {
+	if a.diffSave {
+		_, err := a.SavePolicyDiff(model)
+		return err
+	}
+	if err := a.validateModel(model); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	defer cancel()
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
 		return err
 	}
+	defer unlock()
+	defer a.cache.Invalidate()
 
-	var lines []interface{}
+	// Deleting the rules rather than dropping the collections keeps their
+	// indexes.
+	for _, coll := range a.collections {
+		if _, err := coll.DeleteMany(ctx, bson.D{}); err != nil {
+			return err
+		}
+	}
+
+	lines := make(map[store.Collection][]interface{})
 
 	for ptype, ast := range model["p"] {
+		coll := a.collectionFor("p", ptype)
 		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+			line := a.newLine("p", ptype, rule)
+			lines[coll] = append(lines[coll], &line)
 		}
 	}
 
 	for ptype, ast := range model["g"] {
+		coll := a.collectionFor("g", ptype)
 		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+			line := a.newLine("g", ptype, rule)
+			lines[coll] = append(lines[coll], &line)
 		}
 	}
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
 
-	if _, err := a.collection.InsertMany(ctx, lines); err != nil {
-		return err
+	var skipped []interface{}
+	for _, coll := range a.collections {
+		if len(lines[coll]) == 0 {
+			continue
+		}
+		dups, err := a.insertRules(ctx, coll, lines[coll])
+		if err != nil {
+			return err
+		}
+		skipped = append(skipped, dups...)
 	}
 
+	return a.reportSkipped(skipped)
+}
+
+// insertRules inserts docs into coll. With WithSkipDuplicates the documents
+// are inserted unordered, and those rejected by the unique index are returned
+// instead of failing the insert.
+func (a *adapter) insertRules(ctx context.Context, coll store.Collection, docs []interface{}) ([]interface{}, error) {
+	if !a.skipDups {
+		_, err := coll.InsertMany(ctx, docs)
+		return nil, err
+	}
+	_, err := coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil, nil
+	}
+	indexes, ok := store.DuplicateKeyIndexes(err)
+	if !ok {
+		return nil, err
+	}
+	skipped := make([]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		skipped = append(skipped, docs[i])
+	}
+	return skipped, nil
+}
+
+// reportSkipped passes the rules skipped by insertRules, decrypted, to the
+// function given to WithSkipDuplicates.
+func (a *adapter) reportSkipped(docs []interface{}) error {
+	if a.onSkipped == nil || len(docs) == 0 {
+		return nil
+	}
+	skipped := make([]CasbinRule, 0, len(docs))
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var line CasbinRule
+		if err := bson.Unmarshal(data, &line); err != nil {
+			return err
+		}
+		if line, err = a.cipher.decryptLine(line); err != nil {
+			return err
+		}
+		skipped = append(skipped, line)
+	}
+	a.onSkipped(skipped)
 	return nil
 }
 
 // AddPolicy adds a policy rule to the storage.
 func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
+	if err := a.validateRule(sec, ptype, rule); err != nil {
+		return err
+	}
+	line := a.newLine(sec, ptype, rule)
 
 	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
 	defer cancel()
+	defer a.cache.Invalidate()
 
-	if _, err := a.collection.InsertOne(ctx, line); err != nil {
+	coll := a.collectionFor(sec, ptype)
+	if a.ruleIDs {
+		// Adding a stored rule is a no-op.
+		_, err := coll.UpdateOne(ctx, bson.D{{Key: "_id", Value: line.ID}},
+			bson.D{{Key: "$setOnInsert", Value: line}}, options.Update().SetUpsert(true))
+		return err
+	}
+	if _, err := coll.InsertOne(ctx, line); err != nil {
 		return err
 	}
 
@@ -340,12 +682,13 @@ func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
 
 // RemovePolicy removes a policy rule from the storage.
 func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
+	line := a.cipher.encryptLine(savePolicyLine(sec, ptype, rule))
 
 	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
 	defer cancel()
+	defer a.cache.Invalidate()
 
-	if _, err := a.collection.DeleteOne(ctx, line); err != nil {
+	if _, err := a.collectionFor(sec, ptype).DeleteOne(ctx, ruleFilter(line)); err != nil {
 		return err
 	}
 
@@ -354,7 +697,32 @@ func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
 
 // RemoveFilteredPolicy removes policy rules that match the filter from the storage.
 func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	filter, err := a.fieldFilter(sec, ptype, fieldIndex, fieldValues)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	defer cancel()
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer a.cache.Invalidate()
+
+	if _, err := a.collectionFor(sec, ptype).DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// fieldFilter returns the filter matching the rules of ptype whose values
+// from fieldIndex on are fieldValues. Empty values match any value.
+func (a *adapter) fieldFilter(sec string, ptype string, fieldIndex int, fieldValues []string) (interface{}, error) {
 	selector := make(map[string]interface{})
+	selector["sec"] = sectionSelector(sec, ptype)
 	selector["ptype"] = ptype
 
 	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
@@ -388,14 +756,7 @@ func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int,
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
-	defer cancel()
-
-	if _, err := a.collection.DeleteMany(ctx, selector); err != nil {
-		return err
-	}
-
-	return nil
+	return a.cipher.encryptFilter(selector)
 }
 
 // UpdatePolicy updates a policy rule from storage.
@@ -404,13 +765,21 @@ func (a *adapter) UpdatePolicy(sec string, ptype string, oldRule, newPolicy []st
 	if !a.updatable {
 		return errors.New("cannot save updated policy")
 	}
-	filter := savePolicyLine(ptype, oldRule)
-	update := savePolicyLine(ptype, newPolicy)
+	if err := a.validateRule(sec, ptype, newPolicy); err != nil {
+		return err
+	}
+	filter := ruleFilter(a.cipher.encryptLine(savePolicyLine(sec, ptype, oldRule)))
+	update := a.newLine(sec, ptype, newPolicy)
 
 	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
 	defer cancel()
+	defer a.cache.Invalidate()
 
-	if _, err := a.collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: update}}); err != nil {
+	if a.ruleIDs {
+		_, err := a.replaceRule(ctx, sec, ptype, filter, update)
+		return err
+	}
+	if _, err := a.collectionFor(sec, ptype).UpdateOne(ctx, filter, ruleUpdate(update)); err != nil {
 		return err
 	}
 
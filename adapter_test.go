@@ -22,9 +22,13 @@ import (
 	"os"
 	"testing"
 
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
 	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
 	"github.com/casbin/casbin/v2/util"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var testDbURL = os.Getenv("TEST_MONGODB_URL")
@@ -39,7 +43,14 @@ func getDbURL() string {
 // Setup performs initialization of a fresh dataset for testing.
 // - data should be an array of CasbinRule, as that is the document representation in Mongo
 // for a rule. This ensures data in Mongo is exactly how we would expect to see it.
+// Rules without an arity are given the number of their values, as the adapter stores them.
 func setup(a *adapter, data []interface{}) {
+	for i, doc := range data {
+		if line, ok := doc.(CasbinRule); ok && line.Arity == 0 {
+			line.Arity = len(ruleValues(line))
+			data[i] = line
+		}
+	}
 	if len(data) != 0 {
 		_, err := a.collection.InsertMany(context.TODO(), data)
 		if err != nil {
@@ -51,19 +62,19 @@ func setup(a *adapter, data []interface{}) {
 // setupRBAC performs setup of test data using the model from examples/rbac_model.conf
 func setupRBAC(a *adapter) {
 	setup(a, []interface{}{
-		CasbinRule{nil, "p", "alice", "data1", "read", "", "", ""},
-		CasbinRule{nil, "p", "bob", "data2", "write", "", "", ""},
-		CasbinRule{nil, "p", "data2_admin", "data2", "read", "", "", ""},
-		CasbinRule{nil, "p", "data2_admin", "data2", "write", "", "", ""},
-		CasbinRule{nil, "g", "alice", "data2_admin", "", "", "", ""},
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "data2", V2: "write"},
+		CasbinRule{Sec: "p", PType: "p", V0: "data2_admin", V1: "data2", V2: "read"},
+		CasbinRule{Sec: "p", PType: "p", V0: "data2_admin", V1: "data2", V2: "write"},
+		CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "data2_admin"},
 	})
 }
 
 // setupRBACTenancy performs setup of test data using the model from examples/rbac_tenant_service.conf
 func setupRBACTenancy(a *adapter) {
 	setup(a, []interface{}{
-		CasbinRule{nil, "p", "domain1", "alice", "data3", "read", "accept", "service1"},
-		CasbinRule{nil, "p", "domain1", "alice", "data3", "write", "accept", "service2"},
+		CasbinRule{Sec: "p", PType: "p", V0: "domain1", V1: "alice", V2: "data3", V3: "read", V4: "accept", V5: "service1"},
+		CasbinRule{Sec: "p", PType: "p", V0: "domain1", V1: "alice", V2: "data3", V3: "write", V4: "accept", V5: "service2"},
 	})
 }
 
@@ -222,8 +233,8 @@ func TestFilteredAdapter(t *testing.T) {
 
 	// Setup to populate our test data
 	setup(ma, []interface{}{
-		CasbinRule{nil, "p", "alice", "data1", "write", "", "", ""},
-		CasbinRule{nil, "p", "bob", "data2", "write", "", "", ""},
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data1", V2: "write"},
+		CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "data2", V2: "write"},
 	})
 	defer teardown(ma)
 
@@ -294,7 +305,7 @@ func TestUpdatableAdapter_UpdatePolicy(t *testing.T) {
 	// Modify the rule to allow 'write' access and
 	oldRule := []string{"alice", "data1", "read"}
 	newRule := []string{"alice", "data1", "write"}
-	if err := a.UpdatePolicy("ignored", "p", oldRule, newRule); err != nil {
+	if err := a.UpdatePolicy("p", "p", oldRule, newRule); err != nil {
 		t.Fatal(err)
 	}
 	// Check database and ensure document has been updated. We can use the ID to find.
@@ -307,6 +318,7 @@ func TestUpdatableAdapter_UpdatePolicy(t *testing.T) {
 
 	expected := &CasbinRule{
 		ID:    before.ID,
+		Sec:   "p",
 		PType: before.PType,
 		V0:    "alice",
 		V1:    "data1",
@@ -314,6 +326,9 @@ func TestUpdatableAdapter_UpdatePolicy(t *testing.T) {
 		V3:    "",
 		V4:    "",
 		V5:    "",
+		Arity: 3,
+		// Every update increments the version.
+		Version: 1,
 	}
 
 	if !compare(*expected, *actual) {
@@ -395,3 +410,317 @@ func TestNewAdapterWithDatabase(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestAdapterWithMemoryDatabase(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+	setupRBAC(ma)
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	// The unique index is honoured, so adding an existing rule fails.
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+
+	e.RemoveFilteredPolicy(0, "data2_admin")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+
+	if err := e.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+}
+
+func TestAdapter_Section(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+
+	// Rules stored before the section was persisted have no sec field.
+	setup(ma, []interface{}{
+		CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{PType: "g", V0: "alice", V1: "admin"},
+	})
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A ptype that doesn't start with its section letter.
+	m.AddDef("p", "acl", "sub, obj")
+
+	if err := a.AddPolicy("p", "acl", []string{"bob", "data2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if res := m.GetPolicy("p", "acl"); !util.Array2DEquals([][]string{{"bob", "data2"}}, res) {
+		t.Errorf("Policy: %v, supposed to be [[bob data2]]", res)
+	}
+	if res := m.GetPolicy("g", "g"); !util.Array2DEquals([][]string{{"alice", "admin"}}, res) {
+		t.Errorf("Grouping policy: %v, supposed to be [[alice admin]]", res)
+	}
+
+	var line CasbinRule
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"ptype": "acl"}).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Sec != "p" {
+		t.Errorf("Expected the section to be stored; got %q", line.Sec)
+	}
+
+	// The section is part of the filters, and legacy rules match the section
+	// implied by their ptype.
+	if err := a.RemovePolicy("g", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"ptype": "p"}).Err(); err != nil {
+		t.Errorf("Expected rule of another section to be kept; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"ptype": "p"}).Err(); err != mongo.ErrNoDocuments {
+		t.Errorf("Expected legacy rule to be removed; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "acl", 0, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"ptype": "acl"}).Err(); err != mongo.ErrNoDocuments {
+		t.Errorf("Expected rule to be removed; got %v", err)
+	}
+}
+
+func TestAdapter_SectionMigration(t *testing.T) {
+	db := memory.NewDatabase()
+	coll := db.Collection(defaultCollection)
+	if _, err := coll.CreateIndex(context.TODO(), mongo.IndexModel{
+		Keys:    legacyRuleIndex,
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	legacy := []interface{}{
+		CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{PType: "g", V0: "alice", V1: "admin"},
+	}
+	if _, err := coll.InsertMany(context.TODO(), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line CasbinRule
+	if err := coll.FindOne(context.TODO(), bson.M{"ptype": "p"}).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Sec != "" {
+		t.Errorf("Expected the legacy rule to be left as it is until migrated; got %q", line.Sec)
+	}
+	if err := a.(MigratingAdapter).MigrateRules(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := coll.FindOne(context.TODO(), bson.M{"ptype": "p"}).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Sec != "p" {
+		t.Errorf("Expected the section to be stored in the legacy rule; got %q", line.Sec)
+	}
+	// The former index is dropped, so the values can be used in another
+	// section, and a legacy rule can be stored again next to its upgrade.
+	if _, err := coll.InsertMany(context.TODO(), []interface{}{
+		CasbinRule{Sec: "q", PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		legacy[1],
+	}); err != nil {
+		t.Fatalf("Expected the former index to be dropped; got %v", err)
+	}
+
+	// The rule stored twice is kept once by the next migration.
+	if err := a.(MigratingAdapter).MigrateRules(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := coll.Find(context.TODO(), bson.M{"ptype": "g"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cursor.Next(context.TODO()) {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expected the rule stored twice to be kept once; got %d", count)
+	}
+}
+
+func TestAdapter_Arity(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+
+	// Rules stored before the arity was persisted lose their trailing empty
+	// values.
+	if _, err := ma.collection.InsertOne(context.TODO(),
+		CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "admin", V2: ""}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range [][]string{{"alice", "", "read"}, {"bob", "data2", ""}} {
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"alice", "", "read"}, {"bob", "data2", ""}}
+	if res := m.GetPolicy("p", "p"); !util.Array2DEquals(expected, res) {
+		t.Errorf("Policy: %q, supposed to be %q", res, expected)
+	}
+	if res := m.GetPolicy("g", "g"); !util.Array2DEquals([][]string{{"alice", "admin"}}, res) {
+		t.Errorf("Grouping policy: %q, supposed to be [[alice admin]]", res)
+	}
+
+	summary, err := ma.SavePolicyDiff(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary != (SaveSummary{Unchanged: 3}) {
+		t.Errorf("Summary: %+v, supposed to leave all rules unchanged", summary)
+	}
+
+	// A rule without the trailing empty value is another rule.
+	if err := a.AddPolicy("p", "p", []string{"bob", "data2"}); err != nil {
+		t.Fatalf("Expected a rule differing by a trailing empty value to be added; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"v0": "bob"}).Err(); err != nil {
+		t.Errorf("Expected the rule with an empty value to be kept; got %v", err)
+	}
+
+	// The migration stores the arity of the former rules.
+	if err := ma.MigrateRules(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	var line CasbinRule
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"ptype": "g"}).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Arity != 2 {
+		t.Errorf("Rule: %+v, supposed to be given arity 2", line)
+	}
+	if err := a.AddPolicy("g", "g", []string{"alice", "admin", ""}); err != nil {
+		t.Errorf("Expected a former rule to be stored with a trailing empty value; got %v", err)
+	}
+}
+
+func TestAdapter_ValuesWithCommas(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := [][]string{
+		{"alice", "/data?fields=a,b", "read"},
+		{" bob", `{"dept": "sales, emea"}`, `"write"`},
+	}
+	for _, rule := range rules {
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	if res := m.GetPolicy("p", "p"); !util.Array2DEquals(rules, res) {
+		t.Errorf("Policy: %q, supposed to be %q", res, rules)
+	}
+
+	m.ClearPolicy()
+	if err := a.(IncrementalFilteredAdapter).LoadIncrementalFilteredPolicy(m, bson.M{"v0": " bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if res := m.GetPolicy("p", "p"); !util.Array2DEquals(rules[1:], res) {
+		t.Errorf("Filtered policy: %q, supposed to be %q", res, rules[1:])
+	}
+}
+
+func TestAdapter_SkipDuplicates(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AddPolicy("p", "p", []string{"alice", "data1", "read"})
+	m.AddPolicy("p", "p", []string{"bob", "data2", "write"})
+	m.AddPolicy("g", "g", []string{"alice", "admin"})
+	// The model itself refuses duplicates.
+	m["p"]["p"].Policy = append(m["p"]["p"].Policy, []string{"alice", "data1", "read"})
+
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SavePolicy(m); err == nil {
+		t.Error("Expected a duplicate rule to fail the save")
+	}
+
+	var skipped []CasbinRule
+	a, err = NewAdapterWithDatabase(memory.NewDatabase(), WithEncryption(testKey, 0),
+		WithSkipDuplicates(func(rules []CasbinRule) {
+			skipped = append(skipped, rules...)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SavePolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].V0 != "alice" || skipped[0].V1 != "data1" {
+		t.Errorf("Skipped: %+v, supposed to be the duplicate rule, decrypted", skipped)
+	}
+
+	loaded, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(loaded); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}
+	if res := loaded.GetPolicy("p", "p"); !util.Array2DEquals(expected, res) {
+		t.Errorf("Policy: %v, supposed to be %v", res, expected)
+	}
+	if res := loaded.GetPolicy("g", "g"); !util.Array2DEquals([][]string{{"alice", "admin"}}, res) {
+		t.Errorf("Grouping policy: %v, supposed to be [[alice admin]]", res)
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// archiveFormat identifies backup archives.
+	archiveFormat = "casbin-mongodb-adapter"
+	// archiveVersion is the version of the archive format written by Backup.
+	archiveVersion = 1
+	// maxArchiveLine is the maximum length of an archive line.
+	maxArchiveLine = 16 << 20
+
+	indexOptionsConflictCode  = 85
+	indexKeySpecsConflictCode = 86
+)
+
+// gzipMagic starts gzip-compressed archives.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ErrInvalidArchive is returned by Restore when the archive is malformed or
+// truncated.
+var ErrInvalidArchive = errors.New("invalid policy archive")
+
+// ErrNoTransactions is returned by Restore on servers without transactions,
+// unless the adapter was created with WithNonTransactionalRestore, and by
+// MigrateRuleIDs.
+var ErrNoTransactions = errors.New("the server doesn't support transactions")
+
+// BackupAdapter is the interface for adapters that can back up the policy to
+// an archive and restore it, without mongodump.
+type BackupAdapter interface {
+	persist.Adapter
+	// Backup writes all rules, with their document IDs and versions, and the
+	// index definitions of the rule collections to w.
+	Backup(ctx context.Context, w io.Writer) error
+	// Restore replaces the stored policy with the one in an archive written by
+	// Backup. The archive is read and checked before anything is changed.
+	Restore(ctx context.Context, r io.Reader) error
+}
+
+// archiveHeader is the first line of an archive.
+type archiveHeader struct {
+	Format      string              `bson:"format"`
+	Version     int                 `bson:"version"`
+	Created     time.Time           `bson:"created"`
+	Collections []archiveCollection `bson:"collections"`
+}
+
+// archiveCollection describes a rule collection in an archive.
+type archiveCollection struct {
+	Name    string         `bson:"name"`
+	Indexes []archiveIndex `bson:"indexes"`
+}
+
+// archiveIndex is an index definition in an archive.
+type archiveIndex struct {
+	Keys                    bson.D `bson:"key"`
+	Name                    string `bson:"name,omitempty"`
+	Unique                  bool   `bson:"unique,omitempty"`
+	Sparse                  bool   `bson:"sparse,omitempty"`
+	ExpireAfterSeconds      *int32 `bson:"expireAfterSeconds,omitempty"`
+	PartialFilterExpression bson.D `bson:"partialFilterExpression,omitempty"`
+}
+
+// archiveLine is a rule line, holding a document of collection C, or the last
+// line of an archive, holding the number of rules.
+type archiveLine struct {
+	C     string   `bson:"c,omitempty"`
+	D     bson.Raw `bson:"d,omitempty"`
+	End   bool     `bson:"end,omitempty"`
+	Count int64    `bson:"count,omitempty"`
+}
+
+// toD converts a document of any type to a bson.D.
+func toD(v interface{}) (bson.D, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	err = bson.Unmarshal(raw, &d)
+	return d, err
+}
+
+// newArchiveIndex returns the archived definition of index.
+func newArchiveIndex(index mongo.IndexModel) (archiveIndex, error) {
+	keys, err := toD(index.Keys)
+	if err != nil {
+		return archiveIndex{}, err
+	}
+	spec := archiveIndex{Keys: keys}
+	if o := index.Options; o != nil {
+		if o.Name != nil {
+			spec.Name = *o.Name
+		}
+		if o.Unique != nil {
+			spec.Unique = *o.Unique
+		}
+		if o.Sparse != nil {
+			spec.Sparse = *o.Sparse
+		}
+		spec.ExpireAfterSeconds = o.ExpireAfterSeconds
+		if o.PartialFilterExpression != nil {
+			if spec.PartialFilterExpression, err = toD(o.PartialFilterExpression); err != nil {
+				return archiveIndex{}, err
+			}
+		}
+	}
+	return spec, nil
+}
+
+// model returns the index described by spec.
+func (spec archiveIndex) model() mongo.IndexModel {
+	o := options.Index()
+	if spec.Name != "" {
+		o.SetName(spec.Name)
+	}
+	if spec.Unique {
+		o.SetUnique(true)
+	}
+	if spec.Sparse {
+		o.SetSparse(true)
+	}
+	if spec.ExpireAfterSeconds != nil {
+		o.SetExpireAfterSeconds(*spec.ExpireAfterSeconds)
+	}
+	if spec.PartialFilterExpression != nil {
+		o.SetPartialFilterExpression(spec.PartialFilterExpression)
+	}
+	return mongo.IndexModel{Keys: spec.Keys, Options: o}
+}
+
+// writeLine writes v to w as a line of canonical extended JSON.
+func writeLine(w io.Writer, v interface{}) error {
+	data, err := bson.MarshalExtJSON(v, true, false)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Backup writes the policy to w as newline-delimited extended JSON: a header
+// describing the collections and their indexes, one line per rule and a
+// trailer with the number of rules. Encrypted values are written encrypted.
+func (a *adapter) Backup(ctx context.Context, w io.Writer) error {
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	header := archiveHeader{
+		Format:  archiveFormat,
+		Version: archiveVersion,
+		Created: time.Now().UTC(),
+	}
+	for _, name := range a.names {
+		c := archiveCollection{Name: name, Indexes: []archiveIndex{}}
+		for _, index := range a.indexes[name] {
+			spec, err := newArchiveIndex(index)
+			if err != nil {
+				return err
+			}
+			c.Indexes = append(c.Indexes, spec)
+		}
+		header.Collections = append(header.Collections, c)
+	}
+
+	bw := bufio.NewWriter(w)
+	out := io.Writer(bw)
+	var zw *gzip.Writer
+	if a.backupGzip {
+		if zw, err = gzip.NewWriterLevel(bw, a.backupLevel); err != nil {
+			return err
+		}
+		out = zw
+	}
+
+	if err := writeLine(out, header); err != nil {
+		return err
+	}
+	var count int64
+	for i, coll := range a.collections {
+		n, err := backupCollection(ctx, coll, a.names[i], out)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+	if err := writeLine(out, archiveLine{End: true, Count: count}); err != nil {
+		return err
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// backupCollection writes a rule line for every document of coll.
+func backupCollection(ctx context.Context, coll store.Collection, name string, w io.Writer) (int64, error) {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var count int64
+	for cursor.Next(ctx) {
+		var doc bson.Raw
+		if err := cursor.Decode(&doc); err != nil {
+			return 0, err
+		}
+		if err := writeLine(w, archiveLine{C: name, D: doc}); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, cursor.Err()
+}
+
+// readArchive reads and checks an archive, which may be gzip-compressed, and
+// returns its header and documents.
+func readArchive(r io.Reader) (archiveHeader, []bson.Raw, error) {
+	var header archiveHeader
+	br := bufio.NewReader(r)
+	in := io.Reader(br)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return header, nil, err
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxArchiveLine)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, fmt.Errorf("%w: empty archive", ErrInvalidArchive)
+	}
+	if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &header); err != nil {
+		return header, nil, fmt.Errorf("%w: bad header: %v", ErrInvalidArchive, err)
+	}
+	if header.Format != archiveFormat {
+		return header, nil, fmt.Errorf("%w: unknown format %q", ErrInvalidArchive, header.Format)
+	}
+	if header.Version != archiveVersion {
+		return header, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, header.Version)
+	}
+
+	var docs []bson.Raw
+	for scanner.Scan() {
+		var line archiveLine
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &line); err != nil {
+			return header, nil, fmt.Errorf("%w: bad line %d: %v", ErrInvalidArchive, len(docs)+2, err)
+		}
+		if line.End {
+			if line.Count != int64(len(docs)) {
+				return header, nil, fmt.Errorf("%w: %d rules, expected %d", ErrInvalidArchive, len(docs), line.Count)
+			}
+			if scanner.Scan() {
+				return header, nil, fmt.Errorf("%w: data after the last line", ErrInvalidArchive)
+			}
+			return header, docs, scanner.Err()
+		}
+		if line.D == nil {
+			return header, nil, fmt.Errorf("%w: no rule on line %d", ErrInvalidArchive, len(docs)+2)
+		}
+		docs = append(docs, line.D)
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, err
+	}
+	return header, nil, fmt.Errorf("%w: the archive is truncated", ErrInvalidArchive)
+}
+
+// isIndexConflict reports whether err is caused by an index that already exists
+// with different options.
+func isIndexConflict(err error) bool {
+	var ce mongo.CommandError
+	return errors.As(err, &ce) && (ce.Code == indexOptionsConflictCode || ce.Code == indexKeySpecsConflictCode)
+}
+
+// Restore replaces the stored policy with the one in the archive read from r.
+// The indexes of the archive are created on the collections of the same name
+// that don't have them yet, and the rules are stored in the collections the
+// current layout routes them to. The rules are replaced in a transaction, so
+// a failed restore leaves the policy unchanged; standalone servers are
+// refused with ErrNoTransactions, unless WithNonTransactionalRestore is set.
+// With WithSkipDuplicates, duplicate rules in the archive are skipped before
+// the transaction, as a write error would abort it.
+func (a *adapter) Restore(ctx context.Context, r io.Reader) error {
+	header, docs, err := readArchive(r)
+	if err != nil {
+		return err
+	}
+	if !a.nonTxRestore {
+		ok, err := store.SupportsTransactions(ctx, a.database)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrNoTransactions
+		}
+	}
+
+	routed := make(map[store.Collection][]interface{})
+	seen := make(map[string]bool)
+	var skipped []interface{}
+	for _, doc := range docs {
+		var line CasbinRule
+		if err := bson.Unmarshal(doc, &line); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		if a.skipDups {
+			key := ruleKey(line)
+			if seen[key] {
+				skipped = append(skipped, doc)
+				continue
+			}
+			seen[key] = true
+		}
+		coll := a.collectionFor(section(line), line.PType)
+		routed[coll] = append(routed[coll], doc)
+	}
+
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer a.cache.Invalidate()
+
+	for _, c := range header.Collections {
+		for i, name := range a.names {
+			if name != c.Name {
+				continue
+			}
+			for _, spec := range c.Indexes {
+				if _, err := a.collections[i].CreateIndex(ctx, spec.model()); err != nil && !isIndexConflict(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	err = a.database.WithTransaction(ctx, func(ctx context.Context) error {
+		for _, coll := range a.collections {
+			if _, err := coll.DeleteMany(ctx, bson.D{}); err != nil {
+				return err
+			}
+			if docs := routed[coll]; len(docs) > 0 {
+				if _, err := coll.InsertMany(ctx, docs); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return a.reportSkipped(skipped)
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// standaloneDatabase is a memory database posing as a standalone server,
+// without transactions.
+type standaloneDatabase struct {
+	*memory.Database
+}
+
+func (standaloneDatabase) SupportsTransactions(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// abortingDatabase is a memory database whose transactions fail to commit
+// after a write error, as on a replica set.
+type abortingDatabase struct {
+	*memory.Database
+	failed bool
+}
+
+func (d *abortingDatabase) Collection(name string) store.Collection {
+	return abortingCollection{Collection: d.Database.Collection(name), db: d}
+}
+
+func (d *abortingDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	d.failed = false
+	err := d.Database.WithTransaction(ctx, fn)
+	if err == nil && d.failed {
+		return errors.New("transaction aborted by a write error")
+	}
+	return err
+}
+
+type abortingCollection struct {
+	store.Collection
+	db *abortingDatabase
+}
+
+func (c abortingCollection) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+
+	res, err := c.Collection.InsertMany(ctx, documents, opts...)
+	if err != nil {
+		c.db.failed = true
+	}
+	return res, err
+}
+
+// ruleIDs returns the IDs and versions of the stored p rules.
+func ruleIDs(t *testing.T, a *adapter) string {
+	t.Helper()
+	res, err := a.FindPolicies(context.TODO(), PolicyQuery{Sec: "p"}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, rule := range res.Rules {
+		ids = append(ids, fmt.Sprintf("%v@%d", rule.ID, rule.Version))
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestAdapter_Backup(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithBackupCompression(gzip.BestCompression))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	ba := a.(BackupAdapter)
+
+	res, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{PType: "p"}, Page{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.(VersionedAdapter).UpdateRule(context.TODO(), res.Rules[0], []string{"alice", "data1", "write"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := ruleIDs(t, a.(*adapter))
+
+	var archive bytes.Buffer
+	if err := ba.Backup(context.TODO(), &archive); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(archive.Bytes(), gzipMagic) {
+		t.Fatal("Expected a gzip-compressed archive")
+	}
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.RemovePolicy("bob", "data2", "write"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ba.Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "write"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if restored := ruleIDs(t, a.(*adapter)); restored != ids {
+		t.Errorf("Restored rules: %s, supposed to be %s", restored, ids)
+	}
+
+	// An uncompressed archive restores into another database, with the rules
+	// routed to the collections of its layout.
+	b, err := NewAdapterWithDatabase(memory.NewDatabase(), WithCollections(map[string]CollectionSpec{"g": {Name: "casbin_role"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := NewAdapterWithDatabase(memory.NewDatabase())
+	setupRBAC(plain.(*adapter))
+	archive.Reset()
+	if err := plain.(BackupAdapter).Backup(context.TODO(), &archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	e, err = casbin.NewEnforcer("examples/rbac_model.conf", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if roles := e.GetGroupingPolicy(); len(roles) != 1 {
+		t.Errorf("Grouping policy: %v, supposed to have one rule", roles)
+	}
+	if err := b.(*adapter).collections[1].FindOne(context.TODO(), bson.M{"ptype": "g"}).Err(); err != nil {
+		t.Errorf("Expected the role to be restored into casbin_role; got %v", err)
+	}
+
+	// A truncated archive is rejected without touching the policy.
+	truncated := archive.Bytes()[:bytes.LastIndexByte(archive.Bytes()[:archive.Len()-1], '\n')+1]
+	if _, err := e.RemovePolicy("bob", "data2", "write"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(truncated)); !errors.Is(err, ErrInvalidArchive) {
+		t.Errorf("Expected ErrInvalidArchive for a truncated archive; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	// Without transactions, restoring needs the caller's consent.
+	db := standaloneDatabase{memory.NewDatabase()}
+	c, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(c.(*adapter))
+	if err := c.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err != ErrNoTransactions {
+		t.Errorf("Expected ErrNoTransactions without transactions; got %v", err)
+	}
+	c, err = NewAdapterWithDatabase(db, WithNonTransactionalRestore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err != nil {
+		t.Errorf("Expected WithNonTransactionalRestore() to allow the restore; got %v", err)
+	}
+}
+
+func TestAdapter_RestoreSkipDuplicates(t *testing.T) {
+	// The archive is taken from a collection without the unique index.
+	src, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := src.(*adapter)
+	setupRBAC(sa)
+	if err := sa.collection.DropIndex(context.TODO(), sa.ruleIndex().Keys); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sa.collection.InsertOne(context.TODO(),
+		CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "data2", V2: "write", Arity: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := src.(BackupAdapter).Backup(context.TODO(), &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &abortingDatabase{Database: memory.NewDatabase()}
+	a, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err == nil {
+		t.Error("Expected a restore of duplicate rules to fail without WithSkipDuplicates")
+	}
+
+	var skipped []CasbinRule
+	a, err = NewAdapterWithDatabase(db, WithSkipDuplicates(func(rules []CasbinRule) {
+		skipped = append(skipped, rules...)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.(BackupAdapter).Restore(context.TODO(), bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 1 || skipped[0].V0 != "bob" {
+		t.Errorf("Skipped rules: %v, supposed to be bob's duplicate", skipped)
+	}
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
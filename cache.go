@@ -0,0 +1,288 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// watchRetryDelay is the delay between attempts to reopen a failed change
+// stream.
+const watchRetryDelay = time.Second
+
+// CacheStats reports the activity of a PolicyCache.
+type CacheStats struct {
+	// Hits is the number of loads served from the cache.
+	Hits uint64
+	// Misses is the number of loads that went to the database.
+	Misses uint64
+	// Evictions is the number of entries dropped to respect the size limits.
+	Evictions uint64
+	// Invalidations is the number of times the cache was cleared because the
+	// collection changed.
+	Invalidations uint64
+	// Entries is the number of cached filters.
+	Entries int
+	// Rules is the number of cached rules across all entries.
+	Rules int
+}
+
+// PolicyCache is an in-process cache of loaded rules keyed by filter. It is
+// cleared whenever a change stream reports a change to a rule collection, and
+// while a change stream isn't open nothing is cached. A cache may be shared by
+// several adapters, as long as they use the same collections and options.
+type PolicyCache struct {
+	maxEntries int
+	maxRules   int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	rules   int
+	gen     uint64
+	stats   CacheStats
+	streams int
+	open    int
+	started bool
+	cancel  context.CancelFunc
+}
+
+// cacheEntry holds the decoded rules matching a filter.
+type cacheEntry struct {
+	key   string
+	lines []CasbinRule
+}
+
+// NewPolicyCache creates a cache holding at most maxEntries filters and
+// maxRules rules in total, evicting the least recently used entries first. A
+// limit of 0 means unlimited.
+func NewPolicyCache(maxEntries int, maxRules int) *PolicyCache {
+	return &PolicyCache{
+		maxEntries: maxEntries,
+		maxRules:   maxRules,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Stats returns the current cache statistics.
+func (c *PolicyCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Rules = c.rules
+	return stats
+}
+
+// Close stops watching the collections and clears the cache.
+func (c *PolicyCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.open = 0
+	c.clear()
+}
+
+// Invalidate clears the cache.
+func (c *PolicyCache) Invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clear()
+}
+
+// clear drops all entries. The caller must hold the lock.
+func (c *PolicyCache) clear() {
+	c.gen++
+	c.stats.Invalidations++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.rules = 0
+}
+
+// streamChanged records that a change stream was opened or closed, and clears
+// the cache as changes may have been missed. Streams opened after ctx, the
+// context of the watch, is done are ignored.
+func (c *PolicyCache) streamChanged(ctx context.Context, open bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ctx.Err() != nil {
+		open = false
+	}
+	if open {
+		c.open++
+	} else if c.open > 0 {
+		c.open--
+	}
+	c.clear()
+}
+
+// watching reports whether a change stream is open on every collection. The
+// caller must hold the lock.
+func (c *PolicyCache) watching() bool {
+	return c.streams > 0 && c.open == c.streams
+}
+
+// key returns the cache key of filter, or false if the filter can't be
+// cached.
+func (c *PolicyCache) key(filter interface{}) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	key, err := filterKey(filter)
+	return key, err == nil
+}
+
+// get returns the cached rules for key. It also returns the cache generation,
+// which must be passed to put so that rules read before an invalidation are
+// not cached.
+func (c *PolicyCache) get(key string) ([]CasbinRule, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok && c.watching() {
+		c.stats.Hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry).lines, c.gen, true
+	}
+	c.stats.Misses++
+	return nil, c.gen, false
+}
+
+// put caches lines for key, unless the cache was invalidated since gen.
+func (c *PolicyCache) put(key string, lines []CasbinRule, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.watching() || gen != c.gen {
+		return
+	}
+	if c.maxRules > 0 && len(lines) > c.maxRules {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, lines: lines})
+	c.rules += len(lines)
+
+	for (c.maxEntries > 0 && len(c.entries) > c.maxEntries) || (c.maxRules > 0 && c.rules > c.maxRules) {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops a single entry. The caller must hold the lock.
+func (c *PolicyCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.rules -= len(entry.lines)
+}
+
+// watch starts invalidating the cache on changes to colls, unless it is
+// already watching. The first change streams are opened synchronously so that
+// a deployment without change streams is reported to the caller.
+func (c *PolicyCache) watch(colls []store.Collection) error {
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.started = true
+	c.cancel = cancel
+	c.streams = len(colls)
+	c.mu.Unlock()
+
+	streams := make([]store.ChangeStream, 0, len(colls))
+	for _, coll := range colls {
+		stream, err := coll.Watch(ctx, mongo.Pipeline{})
+		if err != nil {
+			for _, s := range streams {
+				s.Close(context.Background())
+			}
+			cancel()
+			c.mu.Lock()
+			c.started = false
+			c.streams = 0
+			c.mu.Unlock()
+			return err
+		}
+		streams = append(streams, stream)
+	}
+
+	for i, stream := range streams {
+		c.streamChanged(ctx, true)
+		go c.run(ctx, colls[i], stream)
+	}
+	return nil
+}
+
+// run clears the cache on every change event. When the stream ends, because
+// the collection was dropped or the connection failed, caching is suspended
+// until a new stream is open.
+func (c *PolicyCache) run(ctx context.Context, coll store.Collection, stream store.ChangeStream) {
+	followChanges(ctx, coll, stream, c.Invalidate, func(open bool) {
+		c.streamChanged(ctx, open)
+	})
+}
+
+// followChanges calls changed on every change event of coll, starting with
+// stream, until ctx is done. When a stream ends, it calls reopened with false,
+// opens a new stream, retrying every watchRetryDelay, and calls reopened with
+// true once it is open.
+func followChanges(ctx context.Context, coll store.Collection, stream store.ChangeStream,
+	changed func(), reopened func(open bool)) {
+
+	for {
+		for stream.Next(ctx) {
+			changed()
+		}
+		stream.Close(context.Background())
+		reopened(false)
+
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			var err error
+			if stream, err = coll.Watch(ctx, mongo.Pipeline{}); err == nil {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+		}
+		reopened(true)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_Cache(t *testing.T) {
+	db := memory.NewDatabase()
+	cache := NewPolicyCache(1, 0)
+	defer cache.Close()
+
+	a, err := NewAdapterWithDatabase(db, WithCache(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+
+	// Another adapter on the same collection, whose writes are only seen
+	// through the change stream.
+	writer, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e1, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e2, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Rules != 5 {
+		t.Errorf("Unexpected stats after two loads: %+v", stats)
+	}
+
+	// A second filter evicts the first entry.
+	if err := e1.LoadFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 1 || stats.Rules != 1 {
+		t.Errorf("Unexpected stats after eviction: %+v", stats)
+	}
+
+	invalidations := cache.Stats().Invalidations
+	if err := writer.AddPolicy("p", "p", []string{"bob", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Stats().Invalidations == invalidations {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the change stream to invalidate the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := e1.LoadFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e1, [][]string{{"bob", "data2", "write"}, {"bob", "data3", "read"}})
+}
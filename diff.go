@@ -0,0 +1,163 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SaveSummary reports the outcome of a differential save.
+type SaveSummary struct {
+	// Inserted is the number of rules added to the storage.
+	Inserted int
+	// Deleted is the number of rules removed from the storage.
+	Deleted int
+	// Unchanged is the number of stored rules that were left untouched.
+	Unchanged int
+}
+
+// DiffAdapter is the interface for adapters that can save a policy by writing
+// only the rules that changed.
+type DiffAdapter interface {
+	persist.Adapter
+	// SavePolicyDiff saves the policy by inserting the rules missing from the
+	// storage and deleting the stored rules missing from the model.
+	SavePolicyDiff(model model.Model) (SaveSummary, error)
+}
+
+// ruleKey identifies a rule by its section and content, ignoring its document
+// ID.
+func ruleKey(line CasbinRule) string {
+	return strings.Join(append([]string{section(line), line.PType}, ruleValues(line)...), "\x00")
+}
+
+// SavePolicyDiff saves policy to database by applying only the difference
+// between the model and the stored rules in a single bulk write. Unchanged
+// rules keep their documents, so their IDs stay stable.
+func (a *adapter) SavePolicyDiff(model model.Model) (SaveSummary, error) {
+	if a.filtered {
+		return SaveSummary{}, errors.New("cannot save a filtered policy")
+	}
+
+	return a.saveDiff(context.TODO(), model, nil)
+}
+
+// saveDiff applies the difference between model and the stored rules matching
+// scope, which is nil for the whole policy, within the timeout of the adapter
+// or until ctx is done. When saving a scope, rules missing from it may exist
+// outside of it, so they are upserted.
+func (a *adapter) saveDiff(ctx context.Context, model model.Model, scope interface{}) (SaveSummary, error) {
+	var summary SaveSummary
+	if err := a.validateModel(model); err != nil {
+		return summary, err
+	}
+
+	var keys []string
+	wanted := make(map[string]CasbinRule)
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				line := a.newLine(sec, ptype, rule)
+				k := ruleKey(line)
+				if _, ok := wanted[k]; !ok {
+					keys = append(keys, k)
+				}
+				wanted[k] = line
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
+		return summary, err
+	}
+	defer unlock()
+	defer a.cache.Invalidate()
+
+	filter := scope
+	if filter == nil {
+		filter = bson.D{}
+	}
+
+	// Rules stored in another collection than the one they are routed to are
+	// moved.
+	models := make(map[store.Collection][]mongo.WriteModel)
+	stored := make(map[string]bool)
+	for _, coll := range a.collections {
+		cursor, err := coll.Find(ctx, filter)
+		if err != nil {
+			return summary, err
+		}
+		for cursor.Next(ctx) {
+			var line CasbinRule
+			if err := cursor.Decode(&line); err != nil {
+				return summary, err
+			}
+			k := ruleKey(line)
+			if _, ok := wanted[k]; ok && !stored[k] && a.collectionFor(section(line), line.PType) == coll {
+				stored[k] = true
+				summary.Unchanged++
+				continue
+			}
+			models[coll] = append(models[coll], mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: "_id", Value: line.ID}}))
+		}
+		if err := cursor.Close(ctx); err != nil {
+			return summary, err
+		}
+	}
+
+	for _, k := range keys {
+		if stored[k] {
+			continue
+		}
+		line := wanted[k]
+		coll := a.collectionFor(line.Sec, line.PType)
+		if scope == nil {
+			models[coll] = append(models[coll], mongo.NewInsertOneModel().SetDocument(line))
+		} else {
+			models[coll] = append(models[coll], mongo.NewUpdateOneModel().
+				SetFilter(ruleFilter(line)).
+				SetUpdate(bson.D{{Key: "$setOnInsert", Value: line}}).
+				SetUpsert(true))
+		}
+	}
+
+	for _, coll := range a.collections {
+		if len(models[coll]) == 0 {
+			continue
+		}
+		res, err := coll.BulkWrite(ctx, models[coll], options.BulkWrite().SetOrdered(true))
+		if res != nil {
+			summary.Inserted += int(res.InsertedCount + res.UpsertedCount)
+			summary.Deleted += int(res.DeletedCount)
+			summary.Unchanged += int(res.MatchedCount)
+		}
+		if err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
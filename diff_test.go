@@ -0,0 +1,81 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_SavePolicyDiff(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithDiffSave())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+	setupRBAC(ma)
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before CasbinRule
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"v0": "bob"}).Decode(&before); err != nil {
+		t.Fatal(err)
+	}
+
+	e.EnableAutoSave(false)
+	e.AddPolicy("carol", "data3", "read")
+	e.RemovePolicy("alice", "data1", "read")
+
+	summary, err := a.(DiffAdapter).SavePolicyDiff(e.GetModel())
+	if err != nil {
+		t.Fatalf("Expected SavePolicyDiff() to be successful; got %v", err)
+	}
+	if expected := (SaveSummary{Inserted: 1, Deleted: 1, Unchanged: 4}); summary != expected {
+		t.Errorf("Summary: %+v, supposed to be %+v", summary, expected)
+	}
+
+	// Unchanged rules keep their documents.
+	var after CasbinRule
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"v0": "bob"}).Decode(&after); err != nil {
+		t.Fatal(err)
+	}
+	if before.ID != after.ID {
+		t.Errorf("Expected unchanged rule to keep ID %v; got %v", before.ID, after.ID)
+	}
+
+	// SavePolicy uses the differential save as well, so a second save is a no-op.
+	if err := e.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	summary, err = a.(DiffAdapter).SavePolicyDiff(e.GetModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (SaveSummary{Unchanged: 5}); summary != expected {
+		t.Errorf("Summary: %+v, supposed to be %+v", summary, expected)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// encryptedPrefix marks an encrypted value, so that values written before
+// encryption was enabled can still be loaded.
+const encryptedPrefix = "enc:"
+
+// fieldCipher encrypts rule values with a deterministic AEAD: the nonce is an
+// HMAC of the field name and the value, so equal values always have the same
+// ciphertext. This keeps equality filters and the unique index working on
+// encrypted fields, at the cost of revealing which values are equal.
+type fieldCipher struct {
+	aead   cipher.AEAD
+	macKey []byte
+	fields map[string]bool
+}
+
+// newFieldCipher derives the encryption and MAC keys from key, which must be
+// 16, 24 or 32 bytes long, and encrypts the given value positions.
+func newFieldCipher(key []byte, positions []int) (*fieldCipher, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, errors.New("encryption key must be 16, 24 or 32 bytes long")
+	}
+	if len(positions) == 0 {
+		return nil, errors.New("no value positions to encrypt")
+	}
+
+	encKey := deriveKey(key, "encryption")[:len(key)]
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &fieldCipher{
+		aead:   aead,
+		macKey: deriveKey(key, "nonce"),
+		fields: make(map[string]bool),
+	}
+	for _, p := range positions {
+		if p < 0 || p > 5 {
+			return nil, fmt.Errorf("value position %d is out of range", p)
+		}
+		c.fields[fmt.Sprintf("v%d", p)] = true
+	}
+	return c, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// encrypt returns the ciphertext of value stored in field. Empty values are
+// kept as is, as they mark the unused trailing positions of a rule.
+func (c *fieldCipher) encrypt(field string, value string) string {
+	if c == nil || !c.fields[field] || value == "" {
+		return value
+	}
+
+	mac := hmac.New(sha256.New, c.macKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), []byte(field))
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// decrypt returns the plain text of value stored in field.
+func (c *fieldCipher) decrypt(field string, value string) (string, error) {
+	if c == nil || !c.fields[field] || !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value[len(encryptedPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt %s: %v", field, err)
+	}
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return "", fmt.Errorf("cannot decrypt %s: ciphertext too short", field)
+	}
+	plain, err := c.aead.Open(nil, sealed[:n], sealed[n:], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt %s: %v", field, err)
+	}
+	return string(plain), nil
+}
+
+// encryptLine encrypts the configured value positions of line.
+func (c *fieldCipher) encryptLine(line CasbinRule) CasbinRule {
+	line.V0 = c.encrypt("v0", line.V0)
+	line.V1 = c.encrypt("v1", line.V1)
+	line.V2 = c.encrypt("v2", line.V2)
+	line.V3 = c.encrypt("v3", line.V3)
+	line.V4 = c.encrypt("v4", line.V4)
+	line.V5 = c.encrypt("v5", line.V5)
+	return line
+}
+
+// decryptLine decrypts the configured value positions of line.
+func (c *fieldCipher) decryptLine(line CasbinRule) (CasbinRule, error) {
+	var err error
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"v0", &line.V0}, {"v1", &line.V1}, {"v2", &line.V2},
+		{"v3", &line.V3}, {"v4", &line.V4}, {"v5", &line.V5},
+	} {
+		if *f.value, err = c.decrypt(f.name, *f.value); err != nil {
+			return line, err
+		}
+	}
+	return line, nil
+}
+
+// encryptFilter rewrites a selector so that it matches encrypted values.
+// Only equality, $eq, $ne, $in and $nin can be used on encrypted fields.
+func (c *fieldCipher) encryptFilter(filter interface{}) (interface{}, error) {
+	if c == nil {
+		return filter, nil
+	}
+
+	raw, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return c.encryptSelector(doc)
+}
+
+func (c *fieldCipher) encryptSelector(doc bson.D) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			clauses, ok := e.Value.(bson.A)
+			if !ok {
+				return nil, fmt.Errorf("%s must be an array", e.Key)
+			}
+			encrypted := make(bson.A, 0, len(clauses))
+			for _, clause := range clauses {
+				sub, ok := clause.(bson.D)
+				if !ok {
+					return nil, fmt.Errorf("%s entries must be documents", e.Key)
+				}
+				s, err := c.encryptSelector(sub)
+				if err != nil {
+					return nil, err
+				}
+				encrypted = append(encrypted, s)
+			}
+			e.Value = encrypted
+		case c.fields[e.Key]:
+			v, err := c.encryptCondition(e.Key, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			e.Value = v
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (c *fieldCipher) encryptCondition(field string, cond interface{}) (interface{}, error) {
+	switch v := cond.(type) {
+	case string:
+		return c.encrypt(field, v), nil
+	case bson.A:
+		return c.encryptValues(field, v)
+	case bson.D:
+		ops := make(bson.D, 0, len(v))
+		for _, op := range v {
+			switch op.Key {
+			case "$eq", "$ne":
+				s, ok := op.Value.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s on encrypted field %s needs a string", op.Key, field)
+				}
+				op.Value = c.encrypt(field, s)
+			case "$in", "$nin":
+				values, ok := op.Value.(bson.A)
+				if !ok {
+					return nil, fmt.Errorf("%s needs an array", op.Key)
+				}
+				encrypted, err := c.encryptValues(field, values)
+				if err != nil {
+					return nil, err
+				}
+				op.Value = encrypted
+			case "$exists":
+			default:
+				return nil, fmt.Errorf("operator %s is not supported on encrypted field %s", op.Key, field)
+			}
+			ops = append(ops, op)
+		}
+		return ops, nil
+	}
+	return nil, fmt.Errorf("unsupported condition on encrypted field %s", field)
+}
+
+func (c *fieldCipher) encryptValues(field string, values bson.A) (bson.A, error) {
+	out := make(bson.A, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("values of encrypted field %s must be strings", field)
+		}
+		out = append(out, c.encrypt(field, s))
+	}
+	return out, nil
+}
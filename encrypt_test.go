@@ -0,0 +1,94 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestAdapter_Encryption(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db, WithEncryption(testKey, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddPolicy("alice@example.com", "data1", "read")
+	e.AddPolicy("bob@example.com", "data2", "write")
+	e.AddGroupingPolicy("alice@example.com", "admin")
+
+	// Subjects are stored encrypted, other positions in plain text.
+	var line CasbinRule
+	if err := ma.collection.FindOne(context.TODO(), bson.M{"v1": "data1"}).Decode(&line); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line.V0, encryptedPrefix) || strings.Contains(line.V0, "alice") {
+		t.Errorf("Expected v0 to be encrypted; got %q", line.V0)
+	}
+
+	// The unique index still detects duplicates.
+	if err := a.AddPolicy("p", "p", []string{"alice@example.com", "data1", "read"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice@example.com", "data1", "read"}, {"bob@example.com", "data2", "write"}})
+
+	if err := e.LoadFilteredPolicy(bson.M{"v0": bson.M{"$in": bson.A{"bob@example.com"}}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob@example.com", "data2", "write"}})
+
+	if err := e.LoadFilteredPolicy(bson.M{"v0": primitive.Regex{Pattern: "^bob"}}); err == nil {
+		t.Error("Expected a regular expression on an encrypted field to be rejected")
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob@example.com", "data2", "write"}})
+
+	// Values can't be read back with another key.
+	other, err := NewAdapterWithDatabase(db, WithEncryption([]byte("fedcba9876543210fedcba9876543210"), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.LoadPolicy(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicy() to fail with the wrong key")
+	}
+
+	if _, err := NewAdapterWithDatabase(db, WithEncryption([]byte("short"), 0)); err == nil {
+		t.Error("Expected a short key to be rejected")
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+)
+
+// ReloadOption configures NewSyncedEnforcer.
+type ReloadOption func(*reloader) error
+
+// reloader holds the settings of the reload loop of a SyncedEnforcer.
+type reloader struct {
+	interval time.Duration
+	debounce time.Duration
+	filter   interface{}
+	filtered bool
+	onError  func(error)
+}
+
+// WithReloadInterval sets the delay between two reloads when the adapter
+// can't be watched. The default is one minute.
+func WithReloadInterval(interval time.Duration) ReloadOption {
+	return func(r *reloader) error {
+		if interval <= 0 {
+			return errors.New("reload interval must be positive")
+		}
+		r.interval = interval
+		return nil
+	}
+}
+
+// WithReloadDebounce sets the delay during which changes are collected into a
+// single reload. The default is 100ms.
+func WithReloadDebounce(debounce time.Duration) ReloadOption {
+	return func(r *reloader) error {
+		if debounce < 0 {
+			return errors.New("reload debounce must not be negative")
+		}
+		r.debounce = debounce
+		return nil
+	}
+}
+
+// WithReloadFilter makes the enforcer load the rules matching filter instead
+// of the whole policy, from the start.
+func WithReloadFilter(filter interface{}) ReloadOption {
+	return func(r *reloader) error {
+		r.filter = filter
+		r.filtered = true
+		return nil
+	}
+}
+
+// WithReloadErrorHandler sets a function called with the errors of the
+// reloads made in the background, which are otherwise ignored.
+func WithReloadErrorHandler(fn func(error)) ReloadOption {
+	return func(r *reloader) error {
+		r.onError = fn
+		return nil
+	}
+}
+
+// SyncedEnforcer is a casbin.SyncedEnforcer whose policy is reloaded from its
+// adapter whenever the stored rules change. The loaded filters are reloaded as
+// they are, provided the policy is loaded through the methods of
+// SyncedEnforcer rather than those of the embedded enforcer.
+type SyncedEnforcer struct {
+	*casbin.SyncedEnforcer
+
+	r *reloader
+	// mu serializes the loads, so that a reload doesn't restore the filters
+	// replaced by a concurrent load.
+	mu      sync.Mutex
+	filters []interface{}
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSyncedEnforcer creates an enforcer for m and a, loads the policy and
+// keeps it up to date until ctx is done or Close is called. Changes to an
+// adapter of this package are picked up from change streams; other adapters,
+// and deployments without change streams, are reloaded every interval.
+func NewSyncedEnforcer(ctx context.Context, m model.Model, a persist.Adapter, opts ...ReloadOption) (*SyncedEnforcer, error) {
+	r := &reloader{interval: defaultSyncInterval, debounce: syncDebounce}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	se, err := casbin.NewSyncedEnforcer(m)
+	if err != nil {
+		return nil, err
+	}
+	se.SetAdapter(a)
+	e := &SyncedEnforcer{SyncedEnforcer: se, r: r, done: make(chan struct{})}
+	if r.filtered {
+		e.filters = []interface{}{r.filter}
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	var changed <-chan struct{}
+	if ma, ok := a.(*adapter); ok {
+		// Streams are opened before the first load, so no change is missed.
+		changed = watchChanges(ctx, ma.collections)
+	}
+	if err := e.reload(); err != nil {
+		e.cancel()
+		return nil, err
+	}
+	go e.run(ctx, changed)
+	return e, nil
+}
+
+// Close stops reloading the policy.
+func (e *SyncedEnforcer) Close() {
+	e.cancel()
+	<-e.done
+}
+
+// LoadPolicy reloads the whole policy, and keeps reloading it on change.
+func (e *SyncedEnforcer) LoadPolicy() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.SyncedEnforcer.LoadPolicy(); err != nil {
+		return err
+	}
+	e.filters = nil
+	return nil
+}
+
+// LoadFilteredPolicy loads the rules matching filter, and keeps reloading
+// them on change.
+func (e *SyncedEnforcer) LoadFilteredPolicy(filter interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.SyncedEnforcer.LoadFilteredPolicy(filter); err != nil {
+		return err
+	}
+	e.filters = []interface{}{filter}
+	return nil
+}
+
+// LoadIncrementalFilteredPolicy adds the rules matching filter to the loaded
+// ones, and keeps reloading all the loaded filters on change. Merging filters
+// requires an adapter of this package, which reloads them at once.
+func (e *SyncedEnforcer) LoadIncrementalFilteredPolicy(filter interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The whole policy already holds the rules of any filter.
+	if len(e.filters) == 0 {
+		return e.SyncedEnforcer.LoadIncrementalFilteredPolicy(filter)
+	}
+	if _, ok := e.GetAdapter().(*adapter); !ok {
+		return errors.New("merging filtered policies requires an adapter of this package")
+	}
+	// Going through the embedded enforcer loads the rules under its lock and
+	// rebuilds the role links.
+	if err := e.SyncedEnforcer.LoadIncrementalFilteredPolicy(incrementalFilter{filter: filter}); err != nil {
+		return err
+	}
+	e.filters = append(e.filters, filter)
+	return nil
+}
+
+// incrementalFilter makes the LoadFilteredPolicy of an adapter of this
+// package add the rules matching filter to the loaded slices, as by its
+// LoadIncrementalFilteredPolicy, even if the model holds no rule yet.
+type incrementalFilter struct {
+	filter interface{}
+}
+
+// loadedPolicy makes the LoadFilteredPolicy of an adapter of this package
+// move the policy read into model to the model it is called with, and track
+// slices as the loaded ones.
+type loadedPolicy struct {
+	model  model.Model
+	slices []*policySlice
+}
+
+// readSlices reads the rules matching filters into m, as by loading the first
+// filter and then the others incrementally, and returns their slices. The
+// tracked state of the adapter is left untouched.
+func (a *adapter) readSlices(m model.Model, filters []interface{}) ([]*policySlice, error) {
+	var slices []*policySlice
+	for _, filter := range filters {
+		slice, err := newPolicySlice(filter)
+		if err != nil {
+			return nil, err
+		}
+		err = a.forEachLine(context.TODO(), filter, func(line CasbinRule) error {
+			slice.add(line)
+			return loadPolicyLine(line, m)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		replaced := false
+		for i, s := range slices {
+			if s.key == slice.key {
+				slices[i] = slice
+				replaced = true
+			}
+		}
+		if !replaced {
+			slices = append(slices, slice)
+		}
+	}
+	return slices, nil
+}
+
+// movePolicy moves the rules of loaded into m, whose policy becomes the one
+// the adapter tracks along with the slices of loaded.
+func (a *adapter) movePolicy(m model.Model, loaded loadedPolicy) error {
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range loaded.model[sec] {
+			if dst, ok := m[sec][ptype]; ok {
+				dst.Policy = ast.Policy
+				dst.PolicyMap = ast.PolicyMap
+			}
+		}
+	}
+	a.filtered = true
+	a.slices = loaded.slices
+	a.loadedInto = policyMap(m)
+	return nil
+}
+
+// reload loads the policy again, with the loaded filters. Several filters are
+// read into a new model first, which then replaces the policy of the enforcer
+// under its lock, along with the slices tracked by the adapter, so that
+// enforcing never sees a part of them.
+func (e *SyncedEnforcer) reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch len(e.filters) {
+	case 0:
+		return e.SyncedEnforcer.LoadPolicy()
+	case 1:
+		return e.SyncedEnforcer.LoadFilteredPolicy(e.filters[0])
+	}
+
+	m := model.NewModel()
+	current := e.GetModel()
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range current[sec] {
+			m.AddDef(sec, ptype, ast.Value)
+		}
+	}
+	slices, err := e.GetAdapter().(*adapter).readSlices(m, e.filters)
+	if err != nil {
+		return err
+	}
+	return e.SyncedEnforcer.LoadFilteredPolicy(loadedPolicy{model: m, slices: slices})
+}
+
+// run reloads the policy on every notification from changed, or every
+// interval if changed is nil, until ctx is done.
+func (e *SyncedEnforcer) run(ctx context.Context, changed <-chan struct{}) {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.r.interval)
+	defer ticker.Stop()
+	tick := ticker.C
+	if changed != nil {
+		tick = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case <-changed:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(e.r.debounce):
+			}
+			select {
+			case <-changed:
+			default:
+			}
+		}
+
+		if err := e.reload(); err != nil && e.r.onError != nil {
+			e.r.onError(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSyncedEnforcer(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hourly poll is never reached: changes come from the change stream.
+	e, err := NewSyncedEnforcer(context.Background(), m, a,
+		WithReloadInterval(time.Hour), WithReloadDebounce(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	waitForPolicy := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if len(e.GetPolicy()) == n {
+				return
+			}
+		}
+		t.Fatalf("Policy: %v, supposed to have %d rules", e.GetPolicy(), n)
+	}
+
+	waitForPolicy(4)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPolicy(5)
+	if ok, _ := e.Enforce("carol", "data3", "read"); !ok {
+		t.Error("Expected carol to read data3 once the policy is reloaded")
+	}
+
+	// The loaded filter is kept across reloads.
+	if err := e.LoadFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPolicy(1)
+	for _, rule := range [][]string{{"bob", "data3", "read"}, {"dave", "data3", "read"}} {
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPolicy(2)
+	if ok, _ := e.Enforce("dave", "data3", "read"); ok {
+		t.Error("Expected the rules outside the filter not to be loaded")
+	}
+
+	if err := e.LoadIncrementalFilteredPolicy(bson.M{"v0": "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPolicy(2)
+	if ok, _ := e.Enforce("carol", "data3", "read"); !ok {
+		t.Error("Expected the incremental filter to be kept across reloads")
+	}
+
+	// Overlapping filters don't load a rule twice.
+	other, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	om, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlapping, err := NewSyncedEnforcer(context.Background(), om, other,
+		WithReloadInterval(time.Hour), WithReloadDebounce(10*time.Millisecond), WithReloadFilter(bson.M{"v0": "alice"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overlapping.Close()
+	if err := overlapping.LoadIncrementalFilteredPolicy(bson.M{"v1": "data1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"erin", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if overlapping.HasPolicy("erin", "data1", "read") {
+			break
+		}
+	}
+	expected := [][]string{{"alice", "data1", "read"}, {"erin", "data1", "read"}}
+	if policy := overlapping.GetPolicy(); !util.Array2DEquals(expected, policy) {
+		t.Error("Policy: ", policy, ", supposed to be ", expected)
+	}
+
+	if _, err := NewSyncedEnforcer(context.Background(), m, a, WithReloadInterval(0)); err == nil {
+		t.Error("Expected a zero reload interval to be rejected")
+	}
+}
+
+// findHookDatabase is a memory database calling hook before every find.
+type findHookDatabase struct {
+	*memory.Database
+	hook func()
+}
+
+func (d *findHookDatabase) Collection(name string) store.Collection {
+	return findHookCollection{Collection: d.Database.Collection(name), db: d}
+}
+
+type findHookCollection struct {
+	store.Collection
+	db *findHookDatabase
+}
+
+func (c findHookCollection) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (store.Cursor, error) {
+
+	if c.db.hook != nil {
+		c.db.hook()
+	}
+	return c.Collection.Find(ctx, filter, opts...)
+}
+
+func TestSyncedEnforcer_ReloadFilters(t *testing.T) {
+	db := &findHookDatabase{Database: memory.NewDatabase()}
+	a, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewSyncedEnforcer(context.Background(), m, a,
+		WithReloadInterval(time.Hour), WithReloadFilter(bson.M{"v0": "alice"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.LoadIncrementalFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rules are read while the enforcer still holds the whole former
+	// policy.
+	db.hook = func() {
+		if !e.GetModel().HasPolicy("p", "p", []string{"bob", "data2", "write"}) {
+			t.Error("Expected the enforcer to keep the rules of every filter during a reload")
+		}
+	}
+	if err := e.reload(); err != nil {
+		t.Fatal(err)
+	}
+	db.hook = nil
+
+	// The state of the adapter is only changed under the lock of the
+	// enforcer, which reads it to refuse saving a filtered policy.
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		for i := 0; i < 200; i++ {
+			if err := e.SavePolicy(); err == nil {
+				t.Error("Expected saving the filtered policy to fail")
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		if err := e.reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-saved
+
+	expected := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}
+	if policy := e.GetPolicy(); !util.Array2DEquals(expected, policy) {
+		t.Error("Policy: ", policy, ", supposed to be ", expected)
+	}
+	if roles, _ := e.GetRolesForUser("alice"); len(roles) != 1 {
+		t.Error("Roles: ", roles, ", supposed to be rebuilt after a reload")
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxIndexKeys is the maximum number of fields of a compound index.
+const maxIndexKeys = 32
+
+// FieldNames are the names under which the ptype and values of the rules
+// are stored. Empty names keep the default ones, "ptype" and "v0" to "v5".
+type FieldNames struct {
+	PType string
+	V0    string
+	V1    string
+	V2    string
+	V3    string
+	V4    string
+	V5    string
+}
+
+// defaultFields are the default names of the fields that can be renamed.
+// They can't be given to another field, so that filters may use both names.
+var defaultFields = map[string]bool{
+	"ptype": true, "v0": true, "v1": true, "v2": true, "v3": true, "v4": true, "v5": true,
+}
+
+// storedNames maps the default field names to the configured ones. Only the
+// names that differ are included.
+func (f FieldNames) storedNames() (map[string]string, error) {
+	names := make(map[string]string)
+	used := map[string]string{"_id": "_id", "sec": "sec", "arity": "arity", "version": "version"}
+	for _, field := range []struct{ name, stored string }{
+		{"ptype", f.PType},
+		{"v0", f.V0},
+		{"v1", f.V1},
+		{"v2", f.V2},
+		{"v3", f.V3},
+		{"v4", f.V4},
+		{"v5", f.V5},
+	} {
+		stored := field.stored
+		if stored == "" {
+			stored = field.name
+		}
+		if stored != field.name && defaultFields[stored] {
+			return nil, fmt.Errorf("field name %q of %s is the default name of another field", stored, field.name)
+		}
+		if strings.HasPrefix(stored, "$") || strings.Contains(stored, ".") {
+			return nil, fmt.Errorf("invalid field name %q for %s", stored, field.name)
+		}
+		if other, ok := used[stored]; ok {
+			return nil, fmt.Errorf("field name %q of %s is already used by %s", stored, field.name, other)
+		}
+		used[stored] = field.name
+		if stored != field.name {
+			names[field.name] = stored
+		}
+	}
+	return names, nil
+}
+
+// modelFieldNames returns the names under which the values of the rules of
+// each p ptype of m are stored, taken from the tokens of its definition: the
+// values of "p = sub, obj, act" are stored as sub, obj and act.
+func modelFieldNames(m model.Model) (map[string]map[string]string, error) {
+	named := make(map[string]map[string]string)
+	for ptype, ast := range m["p"] {
+		names := make(map[string]string)
+		seen := make(map[string]bool)
+		for i, token := range ast.Tokens {
+			name := strings.TrimPrefix(token, ptype+"_")
+			if i > 5 {
+				return nil, fmt.Errorf("%s defines more than 6 values", ptype)
+			}
+			switch {
+			case name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, "."):
+				return nil, fmt.Errorf("invalid field name %q in %s", name, ptype)
+			case defaultFields[name] || name == "_id" || name == "sec" || name == "arity" || name == "version":
+				return nil, fmt.Errorf("field name %q in %s is already used by the adapter", name, ptype)
+			case seen[name]:
+				return nil, fmt.Errorf("field name %q is used twice in %s", name, ptype)
+			}
+			seen[name] = true
+			names["v"+strconv.Itoa(i)] = name
+		}
+		named[ptype] = names
+	}
+	if n := len(ruleIndexFields(named)); n > maxIndexKeys {
+		return nil, fmt.Errorf("the unique index would have %d fields, more than %d", n, maxIndexKeys)
+	}
+	return named, nil
+}
+
+// ruleIndexFields returns the fields of the unique index on the rules: the
+// section, ptype, values and arity, followed by the names of the named values
+// in order.
+func ruleIndexFields(named map[string]map[string]string) []string {
+	fields := []string{"sec", "ptype", "v0", "v1", "v2", "v3", "v4", "v5", "arity"}
+	seen := make(map[string]bool)
+	var extra []string
+	for _, names := range named {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				extra = append(extra, name)
+			}
+		}
+	}
+	sort.Strings(extra)
+	return append(fields, extra...)
+}
+
+// checkFieldNames checks that the named values don't use the names given to
+// other fields by WithFieldNames.
+func (a *adapter) checkFieldNames() error {
+	for _, stored := range a.fields {
+		for ptype, names := range a.named {
+			for _, name := range names {
+				if name == stored {
+					return fmt.Errorf("field name %q in %s is already used by WithFieldNames", name, ptype)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// encryptFilter rewrites a filter so that it matches encrypted values. The
+// fields given under their configured names are first renamed to the default
+// ones, under which the values are encrypted.
+func (a *adapter) encryptFilter(filter interface{}) (interface{}, error) {
+	if a.cipher == nil || (len(a.fields) == 0 && len(a.named) == 0) {
+		return a.cipher.encryptFilter(filter)
+	}
+
+	raw, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return a.cipher.encryptFilter(a.defaultNames(doc, ""))
+}
+
+// defaultName returns the default name of the field stored as name.
+func defaultName(names map[string]string, name string) (string, bool) {
+	for field, stored := range names {
+		if stored == name {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// defaultNames renames the fields of a selector to their default names. The
+// named values are those of ptype, or of the ptype selected by doc if ptype
+// is empty; without one, a named value is matched in each ptype naming it.
+func (a *adapter) defaultNames(doc bson.D, ptype string) bson.D {
+	renamed := make(bson.D, len(doc))
+	for i, e := range doc {
+		if name, ok := defaultName(a.fields, e.Key); ok {
+			e.Key = name
+		}
+		renamed[i] = e
+	}
+	if ptype == "" {
+		ptype = selectedPType(renamed)
+	}
+
+	out := make(bson.D, 0, len(renamed))
+	var expanded bson.A
+	for _, e := range renamed {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			if clauses, ok := e.Value.(bson.A); ok {
+				translated := make(bson.A, len(clauses))
+				for i, clause := range clauses {
+					translated[i] = clause
+					if sub, ok := clause.(bson.D); ok {
+						translated[i] = a.defaultNames(sub, ptype)
+					}
+				}
+				e.Value = translated
+			}
+		case ptype != "":
+			if name, ok := defaultName(a.named[ptype], e.Key); ok {
+				e.Key = name
+			}
+		default:
+			if x := a.expandNamed(e); x != nil {
+				expanded = append(expanded, x)
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	if len(expanded) == 0 {
+		return out
+	}
+	return bson.D{{Key: "$and", Value: append(bson.A{out}, expanded...)}}
+}
+
+// expandNamed returns a condition matching e in the rules of every ptype
+// naming its field, or nil if none does.
+func (a *adapter) expandNamed(e bson.E) interface{} {
+	ptypes := make([]string, 0, len(a.named))
+	for ptype := range a.named {
+		ptypes = append(ptypes, ptype)
+	}
+	sort.Strings(ptypes)
+
+	var branches bson.A
+	for _, ptype := range ptypes {
+		if name, ok := defaultName(a.named[ptype], e.Key); ok {
+			branches = append(branches, bson.D{{Key: "ptype", Value: ptype}, {Key: name, Value: e.Value}})
+		}
+	}
+	if len(branches) == 0 {
+		return nil
+	}
+	return bson.D{{Key: "$or", Value: branches}}
+}
+
+// selectedPType returns the ptype selected by an equality in doc, or "".
+func selectedPType(doc bson.D) string {
+	for _, e := range doc {
+		switch e.Key {
+		case "ptype":
+			if s, ok := e.Value.(string); ok {
+				return s
+			}
+			if op, ok := e.Value.(bson.D); ok && len(op) == 1 && op[0].Key == "$eq" {
+				s, _ := op[0].Value.(string)
+				return s
+			}
+		case "$and":
+			clauses, _ := e.Value.(bson.A)
+			for _, clause := range clauses {
+				if sub, ok := clause.(bson.D); ok {
+					if s := selectedPType(sub); s != "" {
+						return s
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
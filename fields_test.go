@@ -0,0 +1,245 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_FieldNames(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db, WithFieldNames(FieldNames{
+		PType: "type", V0: "subject", V1: "object", V2: "action",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rule stored by another application.
+	if _, err := db.Collection("casbin_rule").InsertOne(context.TODO(), bson.D{
+		{Key: "type", Value: "g"}, {Key: "subject", Value: "alice"}, {Key: "object", Value: "data2_admin"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddPolicy("data2_admin", "data2", "read"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.AddPolicy("bob", "data1", "write"); err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := db.Collection("casbin_rule").FindOne(context.TODO(), bson.M{"subject": "bob"}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"type", "subject", "object", "action", "v3"} {
+		if _, ok := doc[field]; !ok {
+			t.Errorf("Stored rule: %v, supposed to have a %s field", doc, field)
+		}
+	}
+	if _, ok := doc["v0"]; ok {
+		t.Errorf("Stored rule: %v, supposed not to have a v0 field", doc)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected the rule stored by another application to be loaded")
+	}
+
+	// The unique index is created on the configured names.
+	if err := a.AddPolicy("p", "p", []string{"bob", "data1", "write"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+
+	// Filters may use both names.
+	for _, filter := range []bson.M{{"v0": "bob"}, {"subject": "bob"}} {
+		if err := e.LoadFilteredPolicy(filter); err != nil {
+			t.Fatal(err)
+		}
+		testGetPolicy(t, e, [][]string{{"bob", "data1", "write"}})
+	}
+
+	page, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{PType: "p", SortBy: "v0"}, Page{})
+	if err != nil || len(page.Rules) != 2 || page.Rules[0].V0 != "bob" {
+		t.Fatalf("Rules: %+v, %v, supposed to start with bob's", page.Rules, err)
+	}
+	if _, err := a.(VersionedAdapter).UpdateRule(context.TODO(), page.Rules[0], []string{"bob", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("casbin_rule").FindOne(context.TODO(), bson.M{"subject": "bob", "action": "read"}).Err(); err != nil {
+		t.Errorf("Expected the updated rule to be stored under the configured names; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Collection("casbin_rule").FindOne(context.TODO(), bson.M{"subject": "bob"}).Err(); err == nil {
+		t.Error("Expected the filtered rule to be removed")
+	}
+
+	roles, err := a.(RoleHierarchyAdapter).ImplicitRoles(context.TODO(), "alice", RoleQuery{})
+	if err != nil || roleResults(roles) != "[data2_admin/1/[alice data2_admin]]" {
+		t.Errorf("Roles: %s, %v, supposed to be data2_admin", roleResults(roles), err)
+	}
+
+	for _, names := range []FieldNames{{V0: "v1"}, {V0: "subject", V1: "subject"}, {V2: "sec"}, {V3: "a.b"}} {
+		if _, err := NewAdapterWithDatabase(memory.NewDatabase(), WithFieldNames(names)); err == nil {
+			t.Errorf("Expected field names %+v to be rejected", names)
+		}
+	}
+}
+
+func TestAdapter_NamedFields(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db, WithNamedFields(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+
+	var doc bson.M
+	if err := db.Collection("casbin_rule").FindOne(context.TODO(), bson.M{"sub": "bob"}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["ptype"] != "p" || doc["obj"] != "data2" || doc["act"] != "write" || doc["v0"] != nil {
+		t.Errorf("Stored rule: %v, supposed to use the names of the model", doc)
+	}
+	if err := db.Collection("casbin_rule").FindOne(context.TODO(), bson.M{"v0": "alice", "v1": "data2_admin"}).Err(); err != nil {
+		t.Errorf("Expected the grouping rule to keep its default names; got %v", err)
+	}
+
+	e, err := casbin.NewEnforcer(m, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected alice to read data2 through her role")
+	}
+	if err := a.AddPolicy("p", "p", []string{"bob", "data2", "write"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+	if err := a.AddPolicy("p", "p", []string{"bob", "data2", "read"}); err != nil {
+		t.Errorf("Expected a rule differing by a named value to be added; got %v", err)
+	}
+
+	// Filters may use both names.
+	for _, filter := range []bson.M{{"sub": "bob"}, {"v0": "bob"}} {
+		if err := e.LoadFilteredPolicy(filter); err != nil {
+			t.Fatal(err)
+		}
+		testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"bob", "data2", "read"}})
+	}
+
+	stats, err := a.(StatsAdapter).Stats(context.TODO(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Values[0]["bob"] != 2 || stats.Values[0]["alice"] != 2 || len(stats.TopSubjects) != 3 {
+		t.Errorf("Stats: %+v, supposed to count the named values", stats)
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 2, "read"); err != nil {
+		t.Fatal(err)
+	}
+	page, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{PType: "p", SortBy: "v0", Descending: true}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rules) != 2 || page.Rules[0].V0 != "data2_admin" || page.Rules[1].V0 != "bob" {
+		t.Errorf("Rules: %+v, supposed to be data2_admin's and bob's", page.Rules)
+	}
+	if _, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{Sec: "p", SortBy: "v0"}, Page{}); err == nil {
+		t.Error("Expected sorting the rules of several ptypes by a value to fail")
+	}
+
+	bad := model.NewModel()
+	bad.AddDef("p", "p", "sub, sub")
+	if _, err := NewAdapterWithDatabase(memory.NewDatabase(), WithNamedFields(bad)); err == nil {
+		t.Error("Expected a model using a name twice to be rejected")
+	}
+	if _, err := NewAdapterWithDatabase(memory.NewDatabase(), WithNamedFields(m),
+		WithFieldNames(FieldNames{V2: "obj"})); err == nil {
+		t.Error("Expected a field name used twice to be rejected")
+	}
+}
+
+func TestAdapter_NamedFieldsOnExistingCollection(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := memory.NewDatabase()
+	if _, err := NewAdapterWithDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rule index of the plain adapter is replaced.
+	a, err := NewAdapterWithDatabase(db, WithNamedFields(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}} {
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatalf("Expected the rules of a ptype to be added; got %v", err)
+		}
+	}
+	if err := a.AddPolicy("p", "p", []string{"bob", "data2", "write"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+}
+
+func TestAdapter_EncryptedFieldNames(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []Option{WithFieldNames(FieldNames{V0: "sub"}), WithNamedFields(m)} {
+		a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithEncryption(testKey, 0), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rule := range [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}} {
+			if _, err := e.AddPolicy(rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Filters on the configured names match the encrypted values.
+		for _, filter := range []bson.M{{"v0": "alice"}, {"sub": "alice"}, {"ptype": "p", "sub": "alice"}} {
+			if err := e.LoadFilteredPolicy(filter); err != nil {
+				t.Fatal(err)
+			}
+			testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+		}
+	}
+}
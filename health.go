@@ -0,0 +1,134 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Topologies reported by ConnectionStatus.
+const (
+	TopologyStandalone = "standalone"
+	TopologyReplicaSet = "replicaSet"
+	TopologySharded    = "sharded"
+)
+
+// ConnectionStatus describes the connection to the server as of the last
+// Ping. Only Ping refreshes it: the other operations return their errors
+// without recording them.
+type ConnectionStatus struct {
+	// Connected reports whether the last Ping succeeded.
+	Connected bool
+	// LastCheck is the time of the last Ping, or zero if Ping was never
+	// called.
+	LastCheck time.Time
+	// LastError is the error of the last failed Ping. It is kept once a
+	// later Ping succeeds.
+	LastError error
+	// ServerVersion is the version of the server.
+	ServerVersion string
+	// Topology is TopologyStandalone, TopologyReplicaSet or TopologySharded.
+	Topology string
+	// SetName is the name of the replica set.
+	SetName string
+	// Primary is the address of the replica set primary.
+	Primary string
+	// Hosts are the addresses of the replica set members.
+	Hosts []string
+}
+
+// HealthAdapter is the interface for adapters reporting the health of their
+// connection, e.g. for readiness probes.
+type HealthAdapter interface {
+	persist.Adapter
+	// Ping checks that the server is reachable and refreshes the status.
+	Ping(ctx context.Context) error
+	// Status returns the status found by the last Ping.
+	Status() ConnectionStatus
+}
+
+// isMasterResult is the part of the isMaster command result describing the
+// topology.
+type isMasterResult struct {
+	Msg     string   `bson:"msg"`
+	SetName string   `bson:"setName"`
+	Primary string   `bson:"primary"`
+	Hosts   []string `bson:"hosts"`
+}
+
+// Ping checks that the server answers and records its version and topology.
+// The server details of the last successful Ping are kept when it fails.
+func (a *adapter) Ping(ctx context.Context) error {
+	a.statusMu.Lock()
+	status := a.status
+	a.statusMu.Unlock()
+
+	status.LastCheck = time.Now()
+	err := a.ping(ctx, &status)
+	status.Connected = err == nil
+	if err != nil {
+		status.LastError = err
+	}
+
+	a.statusMu.Lock()
+	a.status = status
+	a.statusMu.Unlock()
+	return err
+}
+
+func (a *adapter) ping(ctx context.Context, status *ConnectionStatus) error {
+	if err := a.database.RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Err(); err != nil {
+		return err
+	}
+
+	var build struct {
+		Version string `bson:"version"`
+	}
+	if err := a.database.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&build); err != nil {
+		return err
+	}
+	var topology isMasterResult
+	if err := a.database.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&topology); err != nil {
+		return err
+	}
+
+	status.ServerVersion = build.Version
+	status.SetName = topology.SetName
+	status.Primary = topology.Primary
+	status.Hosts = topology.Hosts
+	switch {
+	case topology.Msg == "isdbgrid":
+		status.Topology = TopologySharded
+	case topology.SetName != "":
+		status.Topology = TopologyReplicaSet
+	default:
+		status.Topology = TopologyStandalone
+	}
+	return nil
+}
+
+// Status returns the connection status found by the last Ping.
+func (a *adapter) Status() ConnectionStatus {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+
+	status := a.status
+	status.Hosts = append([]string(nil), status.Hosts...)
+	return status
+}
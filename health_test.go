@@ -0,0 +1,52 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+)
+
+func TestAdapter_Ping(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ha := a.(HealthAdapter)
+
+	if status := ha.Status(); status.Connected || !status.LastCheck.IsZero() {
+		t.Errorf("Expected an unknown status before the first Ping; got %+v", status)
+	}
+
+	if err := ha.Ping(context.TODO()); err != nil {
+		t.Fatalf("Expected Ping() to be successful; got %v", err)
+	}
+	status := ha.Status()
+	if !status.Connected || status.ServerVersion != "memory" || status.Topology != TopologyStandalone || status.LastError != nil {
+		t.Errorf("Unexpected status after a successful Ping: %+v", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if err := ha.Ping(ctx); err == nil {
+		t.Fatal("Expected Ping() to fail with a cancelled context")
+	}
+	status = ha.Status()
+	if status.Connected || status.LastError != context.Canceled || status.ServerVersion != "memory" {
+		t.Errorf("Unexpected status after a failed Ping: %+v", status)
+	}
+}
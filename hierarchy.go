@@ -0,0 +1,200 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RoleQuery restricts a role hierarchy query.
+type RoleQuery struct {
+	// PType is the grouping ptype whose links are followed. The default is
+	// "g".
+	PType string
+	// Domain restricts the query to the links of a domain, stored as the
+	// third value of the grouping rules. Without a domain, the links of all
+	// domains are followed.
+	Domain string
+	// MaxDepth is the maximum number of links between the subject of the
+	// query and a result, or 0 for no limit.
+	MaxDepth int
+}
+
+// RoleResult is a role or user found by a role hierarchy query.
+type RoleResult struct {
+	// Name is the role or user.
+	Name string
+	// Depth is the number of links between the subject of the query and
+	// Name. Direct links have depth 1.
+	Depth int
+	// Path is a shortest chain of names from the subject of the query to
+	// Name, both included.
+	Path []string
+}
+
+// RoleHierarchyAdapter is the interface for adapters answering role hierarchy
+// queries on the server, without loading the grouping rules.
+type RoleHierarchyAdapter interface {
+	persist.Adapter
+	// ImplicitRoles returns the roles of user, directly or through other
+	// roles.
+	ImplicitRoles(ctx context.Context, user string, query RoleQuery) ([]RoleResult, error)
+	// ImplicitUsers returns the users and roles inheriting role, directly or
+	// through other roles.
+	ImplicitUsers(ctx context.Context, role string, query RoleQuery) ([]RoleResult, error)
+}
+
+// roleLink is a grouping rule found by a role hierarchy query, with the links
+// reached from it.
+type roleLink struct {
+	V0    string     `bson:"v0"`
+	V1    string     `bson:"v1"`
+	Links []roleLink `bson:"links"`
+}
+
+// ImplicitRoles returns the roles of user, ordered by depth and name.
+func (a *adapter) ImplicitRoles(ctx context.Context, user string, query RoleQuery) ([]RoleResult, error) {
+	return a.roleHierarchy(ctx, user, query, "v0", "v1")
+}
+
+// ImplicitUsers returns the users and roles inheriting role, ordered by depth
+// and name.
+func (a *adapter) ImplicitUsers(ctx context.Context, role string, query RoleQuery) ([]RoleResult, error) {
+	return a.roleHierarchy(ctx, role, query, "v1", "v0")
+}
+
+// roleHierarchy follows the grouping links from name, going from the from
+// field of a link to its to field. The links are collected with $graphLookup
+// and the paths are rebuilt from them.
+func (a *adapter) roleHierarchy(ctx context.Context, name string, query RoleQuery, from string, to string) ([]RoleResult, error) {
+	if query.MaxDepth < 0 {
+		return nil, errors.New("max depth must not be negative")
+	}
+	if a.cipher != nil && (a.cipher.fields["v0"] || a.cipher.fields["v1"]) {
+		return nil, errors.New("cannot follow the links of encrypted fields v0 and v1")
+	}
+	ptype := query.PType
+	if ptype == "" {
+		ptype = "g"
+	}
+
+	coll := a.collectionFor("g", ptype)
+	links := bson.D{
+		{Key: "sec", Value: sectionSelector("g", ptype)},
+		{Key: "ptype", Value: ptype},
+	}
+	if query.Domain != "" {
+		links = append(links, bson.E{Key: "v2", Value: a.cipher.encrypt("v2", query.Domain)})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: append(bson.D{{Key: from, Value: name}}, links...)}},
+	}
+	if query.MaxDepth != 1 {
+		lookup := bson.D{
+			{Key: "from", Value: a.collectionName(coll)},
+			{Key: "startWith", Value: "$" + to},
+			{Key: "connectFromField", Value: to},
+			{Key: "connectToField", Value: from},
+			{Key: "as", Value: "links"},
+			{Key: "restrictSearchWithMatch", Value: links},
+		}
+		// The links found by $graphLookup start at depth 2.
+		if query.MaxDepth > 1 {
+			lookup = append(lookup, bson.E{Key: "maxDepth", Value: query.MaxDepth - 2})
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$graphLookup", Value: lookup}})
+	}
+
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	edges := make(map[string][]string)
+	addEdge := func(l roleLink) {
+		if from == "v0" {
+			edges[l.V0] = append(edges[l.V0], l.V1)
+		} else {
+			edges[l.V1] = append(edges[l.V1], l.V0)
+		}
+	}
+	for cursor.Next(ctx) {
+		var l roleLink
+		if err := cursor.Decode(&l); err != nil {
+			return nil, err
+		}
+		addEdge(l)
+		for _, linked := range l.Links {
+			addEdge(linked)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return shortestPaths(name, edges, query.MaxDepth), nil
+}
+
+// shortestPaths returns the names reachable from start through edges, with a
+// shortest path to each, up to maxDepth links if it is positive.
+func shortestPaths(start string, edges map[string][]string, maxDepth int) []RoleResult {
+	paths := map[string][]string{start: {start}}
+	frontier := []string{start}
+	var results []RoleResult
+	for depth := 1; len(frontier) > 0 && (maxDepth == 0 || depth <= maxDepth); depth++ {
+		var next []string
+		for _, n := range frontier {
+			targets := edges[n]
+			sort.Strings(targets)
+			for _, t := range targets {
+				if _, ok := paths[t]; ok {
+					continue
+				}
+				path := append(append([]string(nil), paths[n]...), t)
+				paths[t] = path
+				next = append(next, t)
+				results = append(results, RoleResult{Name: t, Depth: depth, Path: path})
+			}
+		}
+		sort.Strings(next)
+		frontier = next
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Depth != results[j].Depth {
+			return results[i].Depth < results[j].Depth
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// collectionName returns the name of a rule collection.
+func (a *adapter) collectionName(coll store.Collection) string {
+	for i, c := range a.collections {
+		if c == coll {
+			return a.names[i]
+		}
+	}
+	return defaultCollection
+}
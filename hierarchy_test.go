@@ -0,0 +1,109 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+)
+
+// roleResults formats results as name/depth/path.
+func roleResults(results []RoleResult) string {
+	var out []string
+	for _, r := range results {
+		out = append(out, fmt.Sprintf("%s/%d/%v", r.Name, r.Depth, r.Path))
+	}
+	return fmt.Sprint(out)
+}
+
+func TestAdapter_RoleHierarchy(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithCollections(map[string]CollectionSpec{
+		"g": {Name: "casbin_grouping"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range [][]string{
+		{"alice", "editor"},
+		{"editor", "viewer"},
+		{"bob", "viewer"},
+		{"viewer", "guest"},
+		{"guest", "editor"},
+		{"carol", "admin", "domain1"},
+		{"admin", "editor", "domain1"},
+		{"carol", "viewer", "domain2"},
+	} {
+		if err := a.AddPolicy("g", "g", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddPolicy("g", "g2", []string{"alice", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	ra := a.(RoleHierarchyAdapter)
+
+	for _, test := range []struct {
+		name     string
+		users    bool
+		subject  string
+		query    RoleQuery
+		expected string
+	}{
+		{"roles", false, "alice", RoleQuery{},
+			"[editor/1/[alice editor] viewer/2/[alice editor viewer] guest/3/[alice editor viewer guest]]"},
+		{"roles up to depth 2", false, "alice", RoleQuery{MaxDepth: 2},
+			"[editor/1/[alice editor] viewer/2/[alice editor viewer]]"},
+		{"direct roles", false, "alice", RoleQuery{MaxDepth: 1},
+			"[editor/1/[alice editor]]"},
+		{"roles of another ptype", false, "alice", RoleQuery{PType: "g2"},
+			"[other/1/[alice other]]"},
+		{"users", true, "viewer", RoleQuery{},
+			"[bob/1/[viewer bob] carol/1/[viewer carol] editor/1/[viewer editor] admin/2/[viewer editor admin] alice/2/[viewer editor alice] guest/2/[viewer editor guest]]"},
+		{"roles in a domain", false, "carol", RoleQuery{Domain: "domain1"},
+			"[admin/1/[carol admin] editor/2/[carol admin editor]]"},
+		{"users in a domain", true, "viewer", RoleQuery{Domain: "domain2"},
+			"[carol/1/[viewer carol]]"},
+		{"unknown user", false, "dave", RoleQuery{}, "[]"},
+	} {
+		var results []RoleResult
+		if test.users {
+			results, err = ra.ImplicitUsers(context.TODO(), test.subject, test.query)
+		} else {
+			results, err = ra.ImplicitRoles(context.TODO(), test.subject, test.query)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if res := roleResults(results); res != test.expected {
+			t.Errorf("%s: %s, supposed to be %s", test.name, res, test.expected)
+		}
+	}
+
+	if _, err := ra.ImplicitRoles(context.TODO(), "alice", RoleQuery{MaxDepth: -1}); err == nil {
+		t.Error("Expected a negative max depth to be rejected")
+	}
+
+	encrypted, err := NewAdapterWithDatabase(memory.NewDatabase(), WithEncryption(testKey, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encrypted.(RoleHierarchyAdapter).ImplicitRoles(context.TODO(), "alice", RoleQuery{}); err == nil {
+		t.Error("Expected a query over encrypted subjects to fail")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrRuleNotFound is returned when no stored rule has the requested ID.
+var ErrRuleNotFound = errors.New("rule not found")
+
+// RuleIDAdapter is the interface for adapters giving access to the rules by
+// their document ID.
+type RuleIDAdapter interface {
+	persist.Adapter
+	// RuleID returns the document ID of a rule, which is derived from its
+	// section, ptype and values. It fails unless the adapter was created
+	// with WithRuleIDs.
+	RuleID(sec string, ptype string, rule []string) (string, error)
+	// GetRuleByID returns the stored rule with the given document ID, or
+	// ErrRuleNotFound.
+	GetRuleByID(ctx context.Context, id interface{}) (CasbinRule, error)
+	// RemoveRuleByID removes the stored rule with the given document ID, or
+	// returns ErrRuleNotFound.
+	RemoveRuleByID(ctx context.Context, id interface{}) error
+	// MigrateRuleIDs gives the rules stored with other IDs the IDs derived
+	// from them. It fails with ErrNoTransactions on servers without
+	// transactions, and may be run again, for example after an interruption.
+	MigrateRuleIDs(ctx context.Context) error
+}
+
+// contentID returns the document ID of a stored rule, as a hash of its
+// section, ptype and values.
+func contentID(line CasbinRule) string {
+	sum := sha256.Sum256([]byte(ruleKey(line)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newLine returns the document storing a rule, with its ID if the IDs are
+// derived from the rules.
+func (a *adapter) newLine(sec string, ptype string, rule []string) CasbinRule {
+	line := a.cipher.encryptLine(savePolicyLine(sec, ptype, rule))
+	if a.ruleIDs {
+		line.ID = contentID(line)
+	}
+	return line
+}
+
+// RuleID returns the document ID of a rule. The ID is derived from the
+// stored values, which are encrypted if encryption is enabled.
+func (a *adapter) RuleID(sec string, ptype string, rule []string) (string, error) {
+	if !a.ruleIDs {
+		return "", errors.New("rule IDs are only derived from the rules with WithRuleIDs")
+	}
+	return a.newLine(sec, ptype, rule).ID.(string), nil
+}
+
+// GetRuleByID returns the stored rule with the given document ID.
+func (a *adapter) GetRuleByID(ctx context.Context, id interface{}) (CasbinRule, error) {
+	for _, coll := range a.collections {
+		var line CasbinRule
+		err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&line)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return CasbinRule{}, err
+		}
+		return a.cipher.decryptLine(line)
+	}
+	return CasbinRule{}, ErrRuleNotFound
+}
+
+// RemoveRuleByID removes the stored rule with the given document ID.
+func (a *adapter) RemoveRuleByID(ctx context.Context, id interface{}) error {
+	defer a.cache.Invalidate()
+
+	for _, coll := range a.collections {
+		res, err := coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+		if err != nil {
+			return err
+		}
+		if res.DeletedCount > 0 {
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// replaceRule replaces the stored rule matching filter with line, as the ID
+// of a rule derived from its values can't be updated. The new document is
+// inserted before the old one is deleted, so that a failed insert leaves the
+// stored rule in place on servers without transactions. The new document
+// takes over the version of the old one, incremented. It reports whether a
+// rule matched filter.
+func (a *adapter) replaceRule(ctx context.Context, sec string, ptype string, filter interface{},
+	line CasbinRule) (bool, error) {
+
+	coll := a.collectionFor(sec, ptype)
+	replaced := false
+	err := a.database.WithTransaction(ctx, func(ctx context.Context) error {
+		var old CasbinRule
+		err := coll.FindOne(ctx, filter).Decode(&old)
+		if err == mongo.ErrNoDocuments {
+			replaced = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		matched := bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: old.ID}}}}}
+
+		// The values are unchanged, so is the ID.
+		if old.ID == line.ID {
+			res, err := coll.UpdateOne(ctx, matched, ruleUpdate(line))
+			if err != nil {
+				return err
+			}
+			replaced = res.MatchedCount > 0
+			return nil
+		}
+
+		line.Version = old.Version + 1
+		if _, err := coll.InsertOne(ctx, line); err != nil {
+			return err
+		}
+		res, err := coll.DeleteOne(ctx, matched)
+		if err != nil {
+			return err
+		}
+		if replaced = res.DeletedCount > 0; !replaced {
+			// The rule was removed or updated meanwhile.
+			_, err = coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: line.ID}})
+		}
+		return err
+	})
+	return replaced, err
+}
+
+// MigrateRuleIDs gives the rules stored without WithRuleIDs the IDs derived
+// from their values, so that the IDs of a collection share a type, which the
+// page cursors of FindPolicies compare. Each rule is moved to its new ID in a
+// transaction, as its copy can't be inserted before it is deleted; a rule
+// whose ID is taken already is removed.
+func (a *adapter) MigrateRuleIDs(ctx context.Context) error {
+	if !a.ruleIDs {
+		return errors.New("rule IDs are only derived from the rules with WithRuleIDs")
+	}
+	ok, err := store.SupportsTransactions(ctx, a.database)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoTransactions
+	}
+	defer a.cache.Invalidate()
+
+	for _, coll := range a.collections {
+		if err := a.migrateRuleIDs(ctx, coll); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRuleIDs moves the rules of coll stored with other IDs than strings
+// to their derived IDs.
+func (a *adapter) migrateRuleIDs(ctx context.Context, coll store.Collection) error {
+	cursor, err := coll.Find(ctx, bson.D{{Key: "_id", Value: bson.D{
+		{Key: "$not", Value: bson.D{{Key: "$type", Value: "string"}}},
+	}}})
+	if err != nil {
+		return err
+	}
+	var lines []CasbinRule
+	for cursor.Next(ctx) {
+		var line CasbinRule
+		if err := cursor.Decode(&line); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if err := cursor.Err(); err != nil {
+		cursor.Close(ctx)
+		return err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		id := contentID(line)
+		err := a.database.WithTransaction(ctx, func(ctx context.Context) error {
+			res, err := coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: line.ID}})
+			if err != nil || res.DeletedCount == 0 {
+				return err
+			}
+			err = coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Err()
+			if err != mongo.ErrNoDocuments {
+				return err
+			}
+			moved := line
+			moved.ID = id
+			_, err = coll.InsertOne(ctx, moved)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
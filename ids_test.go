@@ -0,0 +1,205 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_RuleIDs(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewUpdatableAdapterWithDatabase(db, WithRuleIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAdapterWithDatabase(db, WithRuleIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ia := a.(RuleIDAdapter)
+
+	// The same rule added by two processes is stored once.
+	rule := []string{"alice", "data1", "read"}
+	for _, ad := range []persist.Adapter{a, other, a} {
+		if err := ad.AddPolicy("p", "p", rule); err != nil {
+			t.Fatalf("Expected adding a stored rule to be a no-op; got %v", err)
+		}
+	}
+	id, err := ia.RuleID("p", "p", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := other.(RuleIDAdapter).RuleID("p", "p", rule); other != id {
+		t.Errorf("ID: %s, supposed to be the same for every adapter: %s", other, id)
+	}
+	if empty, _ := ia.RuleID("p", "p", []string{"alice", "data1", "read", ""}); empty == id {
+		t.Error("Expected a rule with a trailing empty value to have another ID")
+	}
+
+	line, err := ia.GetRuleByID(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line.ID != id || line.V0 != "alice" || line.V2 != "read" {
+		t.Errorf("Rule: %+v, supposed to be alice's with ID %s", line, id)
+	}
+
+	// Updating a rule gives it the ID of its new values.
+	updated, err := a.(VersionedAdapter).UpdateRule(context.TODO(), line, []string{"alice", "data1", "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, _ := ia.RuleID("p", "p", []string{"alice", "data1", "write"})
+	if updated.ID != newID || updated.Version != 1 {
+		t.Errorf("Updated rule: %+v, supposed to have ID %s and version 1", updated, newID)
+	}
+	if _, err := ia.GetRuleByID(context.TODO(), id); err != ErrRuleNotFound {
+		t.Errorf("Expected the former ID to be gone; got %v", err)
+	}
+	var conflict *ConflictError
+	if _, err := a.(VersionedAdapter).UpdateRule(context.TODO(), line, []string{"alice", "data2", "write"}); !errors.As(err, &conflict) {
+		t.Errorf("Expected an update of the former rule to conflict; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"alice", "data1", "write"}, rule); err != nil {
+		t.Fatal(err)
+	}
+	// The rule keeps counting its versions under its new ID, so an update
+	// based on its first version still conflicts.
+	restored, err := ia.GetRuleByID(context.TODO(), id)
+	if err != nil {
+		t.Fatalf("Expected UpdatePolicy() to restore the first ID; got %v", err)
+	}
+	if restored.Version != 2 {
+		t.Errorf("Rule: %+v, supposed to be at version 2", restored)
+	}
+	if _, err := a.(VersionedAdapter).UpdateRule(context.TODO(), line, []string{"alice", "data2", "write"}); !errors.As(err, &conflict) {
+		t.Errorf("Expected an update of the first version to conflict; got %v", err)
+	}
+	// Updating a rule to its own values keeps its document.
+	if err := a.UpdatePolicy("p", "p", rule, rule); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := ia.GetRuleByID(context.TODO(), id); err != nil || line.Version != 3 {
+		t.Errorf("Rule: %+v, %v, supposed to be kept with version 3", line, err)
+	}
+
+	// A save gives the stored rules their derived IDs.
+	if _, err := db.Collection("casbin_rule").InsertOne(context.TODO(),
+		CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "admin", Arity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SavePolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	gid, _ := ia.RuleID("g", "g", []string{"alice", "admin"})
+	if err := ia.RemoveRuleByID(context.TODO(), gid); err != nil {
+		t.Fatal(err)
+	}
+	if err := ia.RemoveRuleByID(context.TODO(), gid); err != ErrRuleNotFound {
+		t.Errorf("Expected removing a removed rule to fail with ErrRuleNotFound; got %v", err)
+	}
+	cursor, err := db.Collection("casbin_rule").Find(context.TODO(), bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for cursor.Next(context.TODO()) {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("Expected a single rule to be left; got %d", count)
+	}
+
+	plain, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.(RuleIDAdapter).RuleID("p", "p", rule); err == nil {
+		t.Error("Expected RuleID() to fail without WithRuleIDs")
+	}
+}
+
+func TestAdapter_RuleIDsMigration(t *testing.T) {
+	db := memory.NewDatabase()
+	plain, err := NewAdapterWithDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := plain.AddPolicy("p", "p", []string{user, "data1", "read"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := NewAdapterWithDatabase(db, WithRuleIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"carol", "dave"} {
+		if err := a.AddPolicy("p", "p", []string{user, "data1", "read"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The former rules are paged along with the new ones once migrated,
+	// which needs transactions.
+	standalone, err := NewAdapterWithDatabase(standaloneDatabase{db}, WithRuleIDs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := standalone.(RuleIDAdapter).MigrateRuleIDs(context.TODO()); err != ErrNoTransactions {
+		t.Errorf("Expected ErrNoTransactions without transactions; got %v", err)
+	}
+	if err := a.(RuleIDAdapter).MigrateRuleIDs(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	page := Page{Size: 1}
+	for {
+		res, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{PType: "p"}, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range res.Rules {
+			users = append(users, line.V0)
+		}
+		if res.Next == "" {
+			break
+		}
+		page.Cursor = res.Next
+	}
+	if len(users) != 4 {
+		t.Errorf("Paged rules: %v, supposed to hold the 4 stored rules", users)
+	}
+
+	id, _ := a.(RuleIDAdapter).RuleID("p", "p", []string{"alice", "data1", "read"})
+	if _, err := a.(RuleIDAdapter).GetRuleByID(context.TODO(), id); err != nil {
+		t.Errorf("Expected a former rule to be given its derived ID; got %v", err)
+	}
+}
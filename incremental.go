@@ -0,0 +1,220 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IncrementalFilteredAdapter is the interface for filtered adapters that can
+// merge several slices of the policy into one model and unload them again.
+// After changing the model, the role links of the enforcer must be rebuilt
+// with BuildRoleLinks.
+type IncrementalFilteredAdapter interface {
+	persist.FilteredAdapter
+	// LoadIncrementalFilteredPolicy adds the rules matching filter to model,
+	// keeping the rules already loaded.
+	LoadIncrementalFilteredPolicy(model model.Model, filter interface{}) error
+	// UnloadFilteredPolicy removes the rules loaded with filter from model,
+	// except those also loaded by another filter.
+	UnloadFilteredPolicy(model model.Model, filter interface{}) error
+	// LoadedFilters returns the filters currently loaded.
+	LoadedFilters() []interface{}
+	// SaveFilteredPolicy saves the loaded slices of the policy, leaving the
+	// rules outside of the loaded filters untouched.
+	SaveFilteredPolicy(model model.Model) (SaveSummary, error)
+}
+
+// filterKey returns a string identifying filter.
+func filterKey(filter interface{}) (string, error) {
+	if filter == nil {
+		return "", nil
+	}
+	b, err := bson.MarshalExtJSON(filter, true, false)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// sliceRule is a rule loaded as part of a policy slice.
+type sliceRule struct {
+	sec   string
+	ptype string
+	rule  []string
+}
+
+// policySlice records the rules loaded with a filter.
+type policySlice struct {
+	key    string
+	filter interface{}
+	rules  map[string]sliceRule
+}
+
+func newPolicySlice(filter interface{}) (*policySlice, error) {
+	key, err := filterKey(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &policySlice{key: key, filter: filter, rules: make(map[string]sliceRule)}, nil
+}
+
+// add records a loaded line.
+func (s *policySlice) add(line CasbinRule) {
+	rule := ruleValues(line)
+	if len(rule) == 0 {
+		return
+	}
+	r := sliceRule{sec: section(line), ptype: line.PType, rule: rule}
+	s.rules[r.key()] = r
+}
+
+func (r sliceRule) key() string {
+	return r.sec + model.DefaultSep + r.ptype + model.DefaultSep + strings.Join(r.rule, model.DefaultSep)
+}
+
+// slice returns the loaded slice of filter, if any.
+func (a *adapter) slice(key string) (int, bool) {
+	for i, s := range a.slices {
+		if s.key == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// LoadIncrementalFilteredPolicy loads the rules matching filter into model
+// without removing the rules already loaded. Loading a filter again picks up
+// the rules added to the database since.
+func (a *adapter) LoadIncrementalFilteredPolicy(m model.Model, filter interface{}) error {
+	if filter == nil {
+		return errors.New("a filter is required to load a policy incrementally")
+	}
+	slice, err := newPolicySlice(filter)
+	if err != nil {
+		return err
+	}
+
+	err = a.forEachLine(context.TODO(), filter, func(line CasbinRule) error {
+		slice.add(line)
+		return loadPolicyLine(line, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	if i, ok := a.slice(slice.key); ok {
+		a.slices[i] = slice
+	} else {
+		a.slices = append(a.slices, slice)
+	}
+	a.filtered = true
+	a.loadedInto = policyMap(m)
+	return nil
+}
+
+// policyMap returns the rule index of the first policy assertion of m. It
+// identifies the policy of m, as Model.ClearPolicy, which the enforcer calls
+// before LoadPolicy and LoadFilteredPolicy, replaces it.
+func policyMap(m model.Model) map[string]int {
+	keys := make([]string, 0, len(m["p"]))
+	for key := range m["p"] {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return m["p"][keys[0]].PolicyMap
+}
+
+// loadedIntoPolicy reports whether the adapter last loaded rules into the
+// current policy of m.
+func (a *adapter) loadedIntoPolicy(m model.Model) bool {
+	current := policyMap(m)
+	return a.loadedInto != nil && current != nil &&
+		reflect.ValueOf(a.loadedInto).Pointer() == reflect.ValueOf(current).Pointer()
+}
+
+// UnloadFilteredPolicy removes the rules loaded with filter from model. Rules
+// that were also loaded by another filter that is still loaded are kept.
+func (a *adapter) UnloadFilteredPolicy(m model.Model, filter interface{}) error {
+	key, err := filterKey(filter)
+	if err != nil {
+		return err
+	}
+	i, ok := a.slice(key)
+	if !ok {
+		return errors.New("filter is not loaded")
+	}
+	unloaded := a.slices[i]
+	a.slices = append(a.slices[:i:i], a.slices[i+1:]...)
+
+	for k, r := range unloaded.rules {
+		kept := false
+		for _, s := range a.slices {
+			if _, kept = s.rules[k]; kept {
+				break
+			}
+		}
+		if !kept && m[r.sec][r.ptype] != nil {
+			m.RemovePolicy(r.sec, r.ptype, r.rule)
+		}
+	}
+
+	a.filtered = len(a.slices) > 0
+	return nil
+}
+
+// LoadedFilters returns the filters currently loaded, in load order.
+func (a *adapter) LoadedFilters() []interface{} {
+	filters := make([]interface{}, 0, len(a.slices))
+	for _, s := range a.slices {
+		filters = append(filters, s.filter)
+	}
+	return filters
+}
+
+// SaveFilteredPolicy saves the rules within the loaded filters: stored rules
+// matching a loaded filter but missing from model are deleted, and rules of
+// model missing from the database are inserted. The slices must have been
+// loaded into model, as the scope of the save is taken from them.
+func (a *adapter) SaveFilteredPolicy(m model.Model) (SaveSummary, error) {
+	if len(a.slices) == 0 {
+		return SaveSummary{}, errors.New("no filtered policy is loaded")
+	}
+	if !a.loadedIntoPolicy(m) {
+		return SaveSummary{}, errors.New("the filtered policy was loaded into another model")
+	}
+
+	scope := bson.A{}
+	for _, s := range a.slices {
+		filter, err := a.encryptFilter(s.filter)
+		if err != nil {
+			return SaveSummary{}, err
+		}
+		scope = append(scope, filter)
+	}
+
+	return a.saveDiff(context.TODO(), m, bson.D{{Key: "$or", Value: scope}})
+}
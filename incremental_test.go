@@ -0,0 +1,208 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_IncrementalFilteredPolicy(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	ia := a.(IncrementalFilteredAdapter)
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := bson.M{"v0": "alice"}
+	admin := bson.M{"v0": "data2_admin"}
+
+	if err := e.LoadFilteredPolicy(alice); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+
+	// Pull in another slice without reloading the first one.
+	if err := ia.LoadIncrementalFilteredPolicy(e.GetModel(), admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.BuildRoleLinks(); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if ok, _ := e.Enforce("alice", "data2", "write"); !ok {
+		t.Error("Expected alice to inherit data2_admin's permissions")
+	}
+	if n := len(ia.LoadedFilters()); n != 2 || !ia.IsFiltered() {
+		t.Errorf("Expected 2 loaded filters; got %d", n)
+	}
+
+	// Loading an overlapping slice doesn't duplicate rules.
+	overlap := bson.M{"v1": "data2"}
+	if err := ia.LoadIncrementalFilteredPolicy(e.GetModel(), overlap); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"bob", "data2", "write"}})
+
+	// Unloading keeps the rules still loaded through another filter.
+	if err := ia.UnloadFilteredPolicy(e.GetModel(), admin); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"bob", "data2", "write"}})
+	if err := ia.UnloadFilteredPolicy(e.GetModel(), overlap); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+	if err := ia.UnloadFilteredPolicy(e.GetModel(), overlap); err == nil {
+		t.Error("Expected unloading a filter twice to fail")
+	}
+
+	// Saving the loaded slices leaves the rest of the policy untouched.
+	e.EnableAutoSave(false)
+	e.RemovePolicy("alice", "data1", "read")
+	e.AddPolicy("alice", "data3", "read")
+	summary, err := ia.SaveFilteredPolicy(e.GetModel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (SaveSummary{Inserted: 1, Deleted: 1, Unchanged: 1}); summary != expected {
+		t.Errorf("Summary: %+v, supposed to be %+v", summary, expected)
+	}
+
+	if err := ia.UnloadFilteredPolicy(e.GetModel(), alice); err != nil {
+		t.Fatal(err)
+	}
+	if ia.IsFiltered() {
+		t.Error("Expected the policy not to be filtered once every slice is unloaded")
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data3", "read"}})
+}
+
+func TestAdapter_SaveFilteredPolicyOfAnotherModel(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	e1, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e1.LoadFilteredPolicy(bson.M{"v0": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e2.LoadFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The slices of the adapter are e2's, which e1's model doesn't hold.
+	if _, err := a.(IncrementalFilteredAdapter).SaveFilteredPolicy(e1.GetModel()); err == nil {
+		t.Error("Expected saving a model the adapter didn't load into to fail")
+	}
+	if err := a.(*adapter).collection.FindOne(context.TODO(), bson.M{"v0": "bob"}).Err(); err != nil {
+		t.Errorf("Expected bob's rule to be kept; got %v", err)
+	}
+	if _, err := a.(IncrementalFilteredAdapter).SaveFilteredPolicy(e2.GetModel()); err != nil {
+		t.Errorf("Expected saving the loaded model to succeed; got %v", err)
+	}
+}
+
+func TestAdapter_EnforcerIncrementalFilteredPolicy(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(a.(*adapter), []interface{}{
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data2", V2: "write"},
+		CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "data1", V2: "read"},
+	})
+	ia := a.(IncrementalFilteredAdapter)
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := bson.M{"v0": "alice"}
+	data1 := bson.M{"v1": "data1"}
+
+	if err := e.LoadFilteredPolicy(alice); err != nil {
+		t.Fatal(err)
+	}
+	// casbin adds the rules of an overlapping filter without clearing the
+	// model.
+	if err := e.LoadIncrementalFilteredPolicy(data1); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"alice", "data2", "write"}, {"bob", "data1", "read"}})
+	if n := len(ia.LoadedFilters()); n != 2 || !e.IsFiltered() {
+		t.Errorf("Expected 2 loaded filters; got %d", n)
+	}
+
+	// Unloading a filter keeps the rules still loaded through the other one.
+	if err := ia.UnloadFilteredPolicy(e.GetModel(), data1); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"alice", "data2", "write"}})
+
+	// The whole policy holds the rules of any filter.
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.LoadIncrementalFilteredPolicy(data1); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"alice", "data2", "write"}, {"bob", "data1", "read"}})
+	if e.IsFiltered() {
+		t.Error("Expected the whole policy to stay unfiltered")
+	}
+
+	// A filter matching no rule is loaded as well.
+	if err := e.LoadFilteredPolicy(bson.M{"v0": "nobody"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.LoadIncrementalFilteredPolicy(alice); err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"alice", "data2", "write"}})
+	if n := len(ia.LoadedFilters()); n != 2 {
+		t.Errorf("Expected 2 loaded filters after an empty slice; got %d", n)
+	}
+
+	// A rule of a ptype missing from the model is reported.
+	setup(a.(*adapter), []interface{}{CasbinRule{Sec: "p", PType: "p9", V0: "carol", V1: "data1", V2: "read"}})
+	if err := e.LoadFilteredPolicy(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := ia.LoadIncrementalFilteredPolicy(e.GetModel(), data1); err == nil {
+		t.Error("Expected a rule of an undefined ptype to fail")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoDatabase is the Database backed by a MongoDB server.
+type mongoDatabase struct {
+	db *mongo.Database
+}
+
+// NewMongoDatabase returns a Database backed by db.
+func NewMongoDatabase(db *mongo.Database) Database {
+	return &mongoDatabase{db: db}
+}
+
+func (d *mongoDatabase) Collection(name string) Collection {
+	return &MongoCollection{d.db.Collection(name)}
+}
+
+func (d *mongoDatabase) RunCommand(ctx context.Context, runCommand interface{},
+	opts ...*options.RunCmdOptions) SingleResult {
+
+	return d.db.RunCommand(ctx, runCommand, opts...)
+}
+
+// SupportsTransactions reports whether the server is part of a replica set
+// or a sharded cluster, which support transactions.
+func (d *mongoDatabase) SupportsTransactions(ctx context.Context) (bool, error) {
+	var topology struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := d.db.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&topology); err != nil {
+		return false, err
+	}
+	return topology.SetName != "" || topology.Msg == "isdbgrid", nil
+}
+
+// WithTransaction runs fn in a transaction. Standalone servers don't support
+// transactions, so fn runs without one there.
+func (d *mongoDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	ok, err := d.SupportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fn(ctx)
+	}
+
+	session, err := d.db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// MongoCollection is the Collection backed by a MongoDB server. The driver
+// collection is embedded so that operations not covered by Collection stay
+// reachable.
+type MongoCollection struct {
+	*mongo.Collection
+}
+
+// Find executes a find command against the server.
+func (c *MongoCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error) {
+	cursor, err := c.Collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// FindOne executes a find command against the server and returns at most one
+// document.
+func (c *MongoCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) SingleResult {
+	return c.Collection.FindOne(ctx, filter, opts...)
+}
+
+// FindOneAndUpdate updates a single document and returns it.
+func (c *MongoCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) SingleResult {
+
+	return c.Collection.FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+// CreateIndex creates a single index described by model.
+func (c *MongoCollection) CreateIndex(ctx context.Context, model mongo.IndexModel) (string, error) {
+	return c.Collection.Indexes().CreateOne(ctx, model)
+}
+
+// DropIndex drops the index on keys with the dropIndexes command, which
+// accepts a key document in place of an index name.
+func (c *MongoCollection) DropIndex(ctx context.Context, keys interface{}) error {
+	err := c.Collection.Database().RunCommand(ctx, bson.D{
+		{Key: "dropIndexes", Value: c.Collection.Name()},
+		{Key: "index", Value: keys},
+	}).Err()
+	var ce mongo.CommandError
+	if errors.As(err, &ce) && (ce.Code == indexNotFoundCode || ce.Code == namespaceNotFoundCode) {
+		return nil
+	}
+	return err
+}
+
+// Watch opens a change stream on the collection.
+func (c *MongoCollection) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (ChangeStream, error) {
+
+	stream, err := c.Collection.Watch(ctx, pipeline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Aggregate executes an aggregate command against the server.
+func (c *MongoCollection) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (Cursor, error) {
+
+	cursor, err := c.Collection.Aggregate(ctx, pipeline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
@@ -0,0 +1,500 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// renamer translates field names between the caller and the stored
+// documents. Values are already normalized to bson.D and bson.A.
+type renamer interface {
+	// document translates a document to insert or a replacement.
+	document(doc interface{}) interface{}
+	// filter translates a query filter.
+	filter(filter interface{}) interface{}
+	// update translates an update applied to the documents matching filter.
+	update(filter interface{}, update interface{}) interface{}
+	// keys translates the sort or projection of a query with filter.
+	keys(filter interface{}, keys interface{}) interface{}
+	// index translates the keys of an index.
+	index(keys interface{}) interface{}
+	// pipeline translates an aggregation pipeline.
+	pipeline(pipeline interface{}) interface{}
+	// back translates a stored document back.
+	back(doc bson.D) interface{}
+}
+
+// renamedCollection stores the fields of its documents under the names given
+// by a renamer.
+type renamedCollection struct {
+	coll Collection
+	r    renamer
+}
+
+// fieldRenamer renames fields whatever the document.
+type fieldRenamer struct {
+	// names maps the field names used by the caller to the stored ones, and
+	// fields maps them back.
+	names  map[string]string
+	fields map[string]string
+}
+
+// RenameFields returns a collection storing the fields of its documents
+// under other names, given by names. Documents, filters, updates, pipelines,
+// sort and projection options and index keys are translated on the way in,
+// and the documents read are translated back. Values are never changed,
+// except field paths such as "$v0" in pipeline stages other than $match.
+// Change streams are not translated.
+func RenameFields(coll Collection, names map[string]string) Collection {
+	fields := make(map[string]string, len(names))
+	for from, to := range names {
+		fields[to] = from
+	}
+	return &renamedCollection{coll: coll, r: fieldRenamer{names: names, fields: fields}}
+}
+
+func (r fieldRenamer) document(doc interface{}) interface{} {
+	return renameKeys(r.names, doc)
+}
+
+func (r fieldRenamer) filter(filter interface{}) interface{} {
+	return renameKeys(r.names, filter)
+}
+
+func (r fieldRenamer) update(_ interface{}, update interface{}) interface{} {
+	return renameKeys(r.names, update)
+}
+
+func (r fieldRenamer) keys(_ interface{}, keys interface{}) interface{} {
+	return renameKeys(r.names, keys)
+}
+
+func (r fieldRenamer) index(keys interface{}) interface{} {
+	return renameKeys(r.names, keys)
+}
+
+func (r fieldRenamer) pipeline(pipeline interface{}) interface{} {
+	return renamePipeline(r.names, pipeline)
+}
+
+func (r fieldRenamer) back(doc bson.D) interface{} {
+	return renameKeys(r.fields, doc)
+}
+
+// normalize converts v to the bson.D, bson.A and primitive values a document
+// decodes to.
+func normalize(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, string:
+		return v, nil
+	}
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d[0].Value, nil
+}
+
+// rename returns the name of a field, or of the first element of a dotted
+// path, in names.
+func rename(names map[string]string, key string) string {
+	head, rest := key, ""
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		head, rest = key[:i], key[i:]
+	}
+	if to, ok := names[head]; ok {
+		return to + rest
+	}
+	return key
+}
+
+// renameKeys renames the keys of the documents in v, at any depth.
+func renameKeys(names map[string]string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			out[i] = bson.E{Key: rename(names, e.Key), Value: renameKeys(names, e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(v))
+		for i, e := range v {
+			out[i] = renameKeys(names, e)
+		}
+		return out
+	}
+	return v
+}
+
+// renameExpr renames the keys and field paths of an aggregation expression.
+func renameExpr(names map[string]string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			value := e.Value
+			switch e.Key {
+			case "connectFromField", "connectToField":
+				if s, ok := value.(string); ok {
+					value = rename(names, s)
+				}
+			case "restrictSearchWithMatch":
+				value = renameKeys(names, value)
+			default:
+				value = renameExpr(names, value)
+			}
+			out[i] = bson.E{Key: rename(names, e.Key), Value: value}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(v))
+		for i, e := range v {
+			out[i] = renameExpr(names, e)
+		}
+		return out
+	case string:
+		if strings.HasPrefix(v, "$") && !strings.HasPrefix(v, "$$") {
+			return "$" + rename(names, v[1:])
+		}
+	}
+	return v
+}
+
+// renamePipeline renames the fields used by the stages of a pipeline.
+func renamePipeline(names map[string]string, v interface{}) interface{} {
+	stages, ok := v.(bson.A)
+	if !ok {
+		return v
+	}
+	out := make(bson.A, len(stages))
+	for i, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok {
+			out[i] = s
+			continue
+		}
+		renamed := make(bson.D, len(stage))
+		for j, e := range stage {
+			switch e.Key {
+			case "$match":
+				renamed[j] = bson.E{Key: e.Key, Value: renameKeys(names, e.Value)}
+			case "$facet":
+				facets, _ := e.Value.(bson.D)
+				f := make(bson.D, len(facets))
+				for k, facet := range facets {
+					f[k] = bson.E{Key: facet.Key, Value: renamePipeline(names, facet.Value)}
+				}
+				renamed[j] = bson.E{Key: e.Key, Value: f}
+			default:
+				renamed[j] = bson.E{Key: e.Key, Value: renameExpr(names, e.Value)}
+			}
+		}
+		out[i] = renamed
+	}
+	return out
+}
+
+// normalizeAll normalizes several values.
+func normalizeAll(vs ...interface{}) ([]interface{}, error) {
+	out := make([]interface{}, len(vs))
+	for i, v := range vs {
+		var err error
+		if out[i], err = normalize(v); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// document translates a document to insert or a replacement.
+func (c *renamedCollection) document(v interface{}) (interface{}, error) {
+	doc, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.document(doc), nil
+}
+
+// filter translates a filter.
+func (c *renamedCollection) filter(v interface{}) (interface{}, error) {
+	f, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.r.filter(f), nil
+}
+
+// update translates a filter and an update.
+func (c *renamedCollection) update(filter interface{}, update interface{}) (interface{}, interface{}, error) {
+	in, err := normalizeAll(filter, update)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.r.filter(in[0]), c.r.update(in[0], in[1]), nil
+}
+
+// query translates a filter with its sort and projection.
+func (c *renamedCollection) query(filter, sort, projection interface{}) (interface{}, interface{}, interface{}, error) {
+	in, err := normalizeAll(filter, sort, projection)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return c.r.filter(in[0]), c.r.keys(in[0], in[1]), c.r.keys(in[0], in[2]), nil
+}
+
+func (c *renamedCollection) InsertOne(ctx context.Context, document interface{},
+	opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+
+	doc, err := c.document(document)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.InsertOne(ctx, doc, opts...)
+}
+
+func (c *renamedCollection) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+
+	docs := make([]interface{}, len(documents))
+	for i, document := range documents {
+		var err error
+		if docs[i], err = c.document(document); err != nil {
+			return nil, err
+		}
+	}
+	return c.coll.InsertMany(ctx, docs, opts...)
+}
+
+func (c *renamedCollection) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+
+	f, err := c.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.DeleteOne(ctx, f, opts...)
+}
+
+func (c *renamedCollection) DeleteMany(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+
+	f, err := c.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.DeleteMany(ctx, f, opts...)
+}
+
+func (c *renamedCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+
+	f, u, err := c.update(filter, update)
+	if err != nil {
+		return nil, err
+	}
+	return c.coll.UpdateOne(ctx, f, u, opts...)
+}
+
+func (c *renamedCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+
+	renamed := make([]mongo.WriteModel, len(models))
+	for i, model := range models {
+		var err error
+		if renamed[i], err = c.model(model); err != nil {
+			return nil, err
+		}
+	}
+	return c.coll.BulkWrite(ctx, renamed, opts...)
+}
+
+// model translates a write model.
+func (c *renamedCollection) model(model mongo.WriteModel) (mongo.WriteModel, error) {
+	var err error
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		r := *m
+		r.Document, err = c.document(m.Document)
+		return &r, err
+	case *mongo.DeleteOneModel:
+		r := *m
+		r.Filter, err = c.filter(m.Filter)
+		return &r, err
+	case *mongo.DeleteManyModel:
+		r := *m
+		r.Filter, err = c.filter(m.Filter)
+		return &r, err
+	case *mongo.ReplaceOneModel:
+		r := *m
+		if r.Filter, err = c.filter(m.Filter); err == nil {
+			r.Replacement, err = c.document(m.Replacement)
+		}
+		return &r, err
+	case *mongo.UpdateOneModel:
+		r := *m
+		r.Filter, r.Update, err = c.update(m.Filter, m.Update)
+		return &r, err
+	case *mongo.UpdateManyModel:
+		r := *m
+		r.Filter, r.Update, err = c.update(m.Filter, m.Update)
+		return &r, err
+	}
+	return nil, fmt.Errorf("unsupported write model %T", model)
+}
+
+func (c *renamedCollection) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (Cursor, error) {
+
+	o := options.MergeFindOptions(opts...)
+	f, sort, projection, err := c.query(filter, o.Sort, o.Projection)
+	if err != nil {
+		return nil, err
+	}
+	o.Sort, o.Projection = sort, projection
+	cursor, err := c.coll.Find(ctx, f, o)
+	if err != nil {
+		return nil, err
+	}
+	return &renamedCursor{Cursor: cursor, r: c.r}, nil
+}
+
+func (c *renamedCollection) FindOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) SingleResult {
+
+	o := options.MergeFindOneOptions(opts...)
+	f, sort, projection, err := c.query(filter, o.Sort, o.Projection)
+	if err != nil {
+		return errResult{err}
+	}
+	o.Sort, o.Projection = sort, projection
+	return &renamedResult{SingleResult: c.coll.FindOne(ctx, f, o), r: c.r}
+}
+
+func (c *renamedCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) SingleResult {
+
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	f, sort, projection, err := c.query(filter, o.Sort, o.Projection)
+	if err != nil {
+		return errResult{err}
+	}
+	_, u, err := c.update(filter, update)
+	if err != nil {
+		return errResult{err}
+	}
+	o.Sort, o.Projection = sort, projection
+	return &renamedResult{SingleResult: c.coll.FindOneAndUpdate(ctx, f, u, o), r: c.r}
+}
+
+func (c *renamedCollection) Drop(ctx context.Context) error {
+	return c.coll.Drop(ctx)
+}
+
+func (c *renamedCollection) CreateIndex(ctx context.Context, model mongo.IndexModel) (string, error) {
+	keys, err := normalize(model.Keys)
+	if err != nil {
+		return "", err
+	}
+	model.Keys = c.r.index(keys)
+	if model.Options != nil && model.Options.PartialFilterExpression != nil {
+		o := *model.Options
+		if o.PartialFilterExpression, err = c.filter(o.PartialFilterExpression); err != nil {
+			return "", err
+		}
+		model.Options = &o
+	}
+	return c.coll.CreateIndex(ctx, model)
+}
+
+func (c *renamedCollection) DropIndex(ctx context.Context, keys interface{}) error {
+	doc, err := normalize(keys)
+	if err != nil {
+		return err
+	}
+	return c.coll.DropIndex(ctx, c.r.index(doc))
+}
+
+func (c *renamedCollection) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (ChangeStream, error) {
+	return c.coll.Watch(ctx, pipeline, opts...)
+}
+
+func (c *renamedCollection) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (Cursor, error) {
+
+	stages, err := normalize(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := c.coll.Aggregate(ctx, c.r.pipeline(stages), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &renamedCursor{Cursor: cursor, r: c.r}, nil
+}
+
+// decodeRenamed decodes a document read with decode into val, after
+// translating it back with r.
+func decodeRenamed(r renamer, decode func(interface{}) error, val interface{}) error {
+	var doc bson.D
+	if err := decode(&doc); err != nil {
+		return err
+	}
+	raw, err := bson.Marshal(r.back(doc))
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, val)
+}
+
+// renamedCursor translates the documents it decodes.
+type renamedCursor struct {
+	Cursor
+	r renamer
+}
+
+func (c *renamedCursor) Decode(val interface{}) error {
+	return decodeRenamed(c.r, c.Cursor.Decode, val)
+}
+
+// renamedResult translates the document it decodes.
+type renamedResult struct {
+	SingleResult
+	r renamer
+}
+
+func (r *renamedResult) Decode(val interface{}) error {
+	return decodeRenamed(r.r, r.SingleResult.Decode, val)
+}
+
+// errResult is a SingleResult failing with err.
+type errResult struct {
+	err error
+}
+
+func (r errResult) Decode(interface{}) error { return r.err }
+func (r errResult) Err() error               { return r.err }
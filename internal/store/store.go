@@ -0,0 +1,159 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store defines the storage interface used by the adapter. The method
+// set mirrors the subset of the MongoDB driver the adapter relies on, so that a
+// *mongo.Collection can be used directly and alternative backends return the
+// same result and error types as the driver.
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Server error codes.
+const (
+	// duplicateKeyCode is the code of a unique index violation.
+	duplicateKeyCode = 11000
+	// namespaceNotFoundCode is the code of a command on a missing collection.
+	namespaceNotFoundCode = 26
+	// indexNotFoundCode is the code of a command on a missing index.
+	indexNotFoundCode = 27
+)
+
+// Database provides access to named collections.
+type Database interface {
+	// Collection returns a handle for the named collection.
+	Collection(name string) Collection
+	// RunCommand runs a database command, such as ping.
+	RunCommand(ctx context.Context, runCommand interface{}, opts ...*options.RunCmdOptions) SingleResult
+	// WithTransaction runs fn in a transaction, which is committed if fn
+	// returns nil and aborted otherwise. Operations must use the context
+	// passed to fn. Backends without transactions run fn directly.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// TransactionChecker is implemented by the databases that can tell whether
+// WithTransaction runs fn in a transaction.
+type TransactionChecker interface {
+	SupportsTransactions(ctx context.Context) (bool, error)
+}
+
+// SupportsTransactions reports whether WithTransaction runs fn in a
+// transaction on db. Databases that can't tell are assumed to.
+func SupportsTransactions(ctx context.Context, db Database) (bool, error) {
+	if c, ok := db.(TransactionChecker); ok {
+		return c.SupportsTransactions(ctx)
+	}
+	return true, nil
+}
+
+// Collection is the set of collection operations used by the adapter.
+type Collection interface {
+	InsertOne(ctx context.Context, document interface{},
+		opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []interface{},
+		opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	DeleteOne(ctx context.Context, filter interface{},
+		opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{},
+		opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel,
+		opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) SingleResult
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.FindOneAndUpdateOptions) SingleResult
+	Drop(ctx context.Context) error
+	// CreateIndex creates a single index described by model.
+	CreateIndex(ctx context.Context, model mongo.IndexModel) (string, error)
+	// DropIndex drops the index on keys. Dropping an index that doesn't
+	// exist is not an error.
+	DropIndex(ctx context.Context, keys interface{}) error
+	Watch(ctx context.Context, pipeline interface{},
+		opts ...*options.ChangeStreamOptions) (ChangeStream, error)
+	Aggregate(ctx context.Context, pipeline interface{},
+		opts ...*options.AggregateOptions) (Cursor, error)
+}
+
+// Cursor iterates over the documents returned by Find or Aggregate.
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// ChangeStream iterates over the change events of a collection. Next blocks
+// until an event is available or the context is done.
+type ChangeStream interface {
+	Next(ctx context.Context) bool
+	Decode(val interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// SingleResult is the result of FindOne, FindOneAndUpdate and RunCommand.
+type SingleResult interface {
+	Decode(v interface{}) error
+	Err() error
+}
+
+// IsDuplicateKey reports whether err was caused by a unique index violation.
+func IsDuplicateKey(err error) bool {
+	var we mongo.WriteException
+	if errors.As(err, &we) {
+		for _, e := range we.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		for _, e := range bwe.WriteErrors {
+			if e.Code == duplicateKeyCode {
+				return true
+			}
+		}
+	}
+	var ce mongo.CommandError
+	if errors.As(err, &ce) {
+		return ce.Code == duplicateKeyCode
+	}
+	return false
+}
+
+// DuplicateKeyIndexes returns the indexes of the documents rejected by a
+// unique index violation in the bulk write that returned err. ok is false if
+// err has any other cause.
+func DuplicateKeyIndexes(err error) (indexes []int, ok bool) {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return nil, false
+	}
+	for _, e := range bwe.WriteErrors {
+		if e.Code != duplicateKeyCode {
+			return nil, false
+		}
+		indexes = append(indexes, e.Index)
+	}
+	return indexes, len(indexes) > 0
+}
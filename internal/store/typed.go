@@ -0,0 +1,362 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// typeRenamer renames the fields of each document according to its type,
+// the string value of a type field.
+type typeRenamer struct {
+	field string
+	// names maps the types to the field names used by the caller and their
+	// stored names, and fields maps them back.
+	names  map[string]map[string]string
+	fields map[string]map[string]string
+	// types lists the types renaming each field, in order.
+	types map[string][]string
+}
+
+// RenameFieldsByType returns a collection storing the fields of each
+// document under names depending on its type, the value of typeField: names
+// maps each type to the fields renamed in its documents. Filters and
+// pipelines selecting a single type with an equality on typeField are
+// translated for that type. Other filters match the renamed fields of every
+// type, and other pipelines read them with $switch expressions; sorts and
+// projections are only translated for a single type. Index keys are not
+// translated. Change streams are not translated.
+func RenameFieldsByType(coll Collection, typeField string, names map[string]map[string]string) Collection {
+	r := typeRenamer{
+		field:  typeField,
+		names:  names,
+		fields: make(map[string]map[string]string, len(names)),
+		types:  make(map[string][]string),
+	}
+	for t, m := range names {
+		r.fields[t] = make(map[string]string, len(m))
+		for from, to := range m {
+			r.fields[t][to] = from
+			r.types[from] = append(r.types[from], t)
+		}
+	}
+	for _, types := range r.types {
+		sort.Strings(types)
+	}
+	return &renamedCollection{coll: coll, r: r}
+}
+
+// typeOf returns the type selected by a filter or held by a document, or ""
+// if there's none.
+func (r typeRenamer) typeOf(v interface{}) string {
+	d, ok := v.(bson.D)
+	if !ok {
+		return ""
+	}
+	for _, e := range d {
+		switch e.Key {
+		case r.field:
+			if s, ok := e.Value.(string); ok {
+				return s
+			}
+			if op, ok := e.Value.(bson.D); ok && len(op) == 1 && op[0].Key == "$eq" {
+				s, _ := op[0].Value.(string)
+				return s
+			}
+		case "$and":
+			conds, _ := e.Value.(bson.A)
+			for _, c := range conds {
+				if t := r.typeOf(c); t != "" {
+					return t
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// renameTop renames the top-level keys of a document.
+func renameTop(names map[string]string, v interface{}) interface{} {
+	d, ok := v.(bson.D)
+	if !ok || len(names) == 0 {
+		return v
+	}
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		out[i] = bson.E{Key: rename(names, e.Key), Value: e.Value}
+	}
+	return out
+}
+
+func (r typeRenamer) document(doc interface{}) interface{} {
+	return renameTop(r.names[r.typeOf(doc)], doc)
+}
+
+func (r typeRenamer) filter(filter interface{}) interface{} {
+	return r.filterOf(filter, "")
+}
+
+// filterOf translates a filter for type t, or for the type it selects if t
+// is empty.
+func (r typeRenamer) filterOf(filter interface{}, t string) interface{} {
+	d, ok := filter.(bson.D)
+	if !ok {
+		return filter
+	}
+	if t == "" {
+		t = r.typeOf(d)
+	}
+
+	out := make(bson.D, 0, len(d))
+	var expanded bson.A
+	for _, e := range d {
+		switch {
+		case e.Key == "$and" || e.Key == "$or" || e.Key == "$nor":
+			conds, _ := e.Value.(bson.A)
+			translated := make(bson.A, len(conds))
+			for i, c := range conds {
+				translated[i] = r.filterOf(c, t)
+			}
+			out = append(out, bson.E{Key: e.Key, Value: translated})
+		case strings.HasPrefix(e.Key, "$"):
+			out = append(out, e)
+		case t != "":
+			out = append(out, bson.E{Key: rename(r.names[t], e.Key), Value: e.Value})
+		default:
+			if x := r.expand(e); x != nil {
+				expanded = append(expanded, x)
+			} else {
+				out = append(out, e)
+			}
+		}
+	}
+	if len(expanded) == 0 {
+		return out
+	}
+	return bson.D{{Key: "$and", Value: append(bson.A{out}, expanded...)}}
+}
+
+// expand returns a condition matching e on the renamed field of every type
+// renaming it and on the field itself for the other types, or nil if no type
+// renames it.
+func (r typeRenamer) expand(e bson.E) interface{} {
+	head := e.Key
+	if i := strings.IndexByte(head, '.'); i >= 0 {
+		head = head[:i]
+	}
+	types := r.types[head]
+	if len(types) == 0 {
+		return nil
+	}
+
+	branches := make(bson.A, 0, len(types)+1)
+	others := make(bson.A, 0, len(types))
+	for _, t := range types {
+		branches = append(branches, bson.D{
+			{Key: r.field, Value: t},
+			{Key: rename(r.names[t], e.Key), Value: e.Value},
+		})
+		others = append(others, t)
+	}
+	branches = append(branches, bson.D{
+		{Key: r.field, Value: bson.D{{Key: "$nin", Value: others}}},
+		e,
+	})
+	return bson.D{{Key: "$or", Value: branches}}
+}
+
+func (r typeRenamer) update(filter interface{}, update interface{}) interface{} {
+	d, ok := update.(bson.D)
+	if !ok {
+		return update
+	}
+	t := r.typeOf(filter)
+	for _, e := range d {
+		if t == "" && (e.Key == "$set" || e.Key == "$setOnInsert") {
+			t = r.typeOf(e.Value)
+		}
+	}
+
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		out[i] = bson.E{Key: e.Key, Value: renameTop(r.names[t], e.Value)}
+	}
+	return out
+}
+
+func (r typeRenamer) keys(filter interface{}, keys interface{}) interface{} {
+	return renameTop(r.names[r.typeOf(filter)], keys)
+}
+
+func (r typeRenamer) index(keys interface{}) interface{} {
+	return keys
+}
+
+func (r typeRenamer) pipeline(pipeline interface{}) interface{} {
+	return r.pipelineOf(pipeline, "")
+}
+
+// pipelineOf translates the stages of a pipeline for type t, or for the
+// type selected by its first $match stage if t is empty.
+func (r typeRenamer) pipelineOf(pipeline interface{}, t string) interface{} {
+	stages, ok := pipeline.(bson.A)
+	if !ok {
+		return pipeline
+	}
+	out := make(bson.A, len(stages))
+	for i, s := range stages {
+		stage, ok := s.(bson.D)
+		if !ok {
+			out[i] = s
+			continue
+		}
+		translated := make(bson.D, len(stage))
+		for j, e := range stage {
+			value := e.Value
+			switch e.Key {
+			case "$match":
+				value = r.filterOf(value, t)
+				if t == "" {
+					t = r.typeOf(e.Value)
+				}
+			case "$facet":
+				facets, _ := value.(bson.D)
+				f := make(bson.D, len(facets))
+				for k, facet := range facets {
+					f[k] = bson.E{Key: facet.Key, Value: r.pipelineOf(facet.Value, t)}
+				}
+				value = f
+			case "$graphLookup":
+				value = r.graphLookup(value, t)
+			case "$sort":
+				value = renameTop(r.names[t], value)
+			default:
+				value = r.expr(value, t)
+			}
+			translated[j] = bson.E{Key: e.Key, Value: value}
+		}
+		out[i] = translated
+	}
+	return out
+}
+
+// graphLookup translates a $graphLookup stage. The links followed are of
+// the type selected by restrictSearchWithMatch, or of t.
+func (r typeRenamer) graphLookup(spec interface{}, t string) interface{} {
+	d, ok := spec.(bson.D)
+	if !ok {
+		return spec
+	}
+	linked := t
+	for _, e := range d {
+		if e.Key == "restrictSearchWithMatch" {
+			if lt := r.typeOf(e.Value); lt != "" {
+				linked = lt
+			}
+		}
+	}
+
+	out := make(bson.D, len(d))
+	for i, e := range d {
+		value := e.Value
+		switch e.Key {
+		case "connectFromField", "connectToField":
+			if s, ok := value.(string); ok {
+				value = rename(r.names[linked], s)
+			}
+		case "restrictSearchWithMatch":
+			value = r.filterOf(value, linked)
+		case "startWith":
+			value = r.expr(value, t)
+		}
+		out[i] = bson.E{Key: e.Key, Value: value}
+	}
+	return out
+}
+
+// expr translates the field paths of an expression for type t. Without a
+// type, the paths of renamed fields are replaced by a $switch on the type.
+func (r typeRenamer) expr(v interface{}, t string) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			out[i] = bson.E{Key: e.Key, Value: r.expr(e.Value, t)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(v))
+		for i, e := range v {
+			out[i] = r.expr(e, t)
+		}
+		return out
+	case string:
+		if !strings.HasPrefix(v, "$") || strings.HasPrefix(v, "$$") {
+			return v
+		}
+		path := v[1:]
+		if t != "" {
+			return "$" + rename(r.names[t], path)
+		}
+		head := path
+		if i := strings.IndexByte(head, '.'); i >= 0 {
+			head = head[:i]
+		}
+		types := r.types[head]
+		if len(types) == 0 {
+			return v
+		}
+		branches := make(bson.A, 0, len(types))
+		for _, t := range types {
+			branches = append(branches, bson.D{
+				{Key: "case", Value: bson.D{{Key: "$eq", Value: bson.A{"$" + r.field, t}}}},
+				{Key: "then", Value: "$" + rename(r.names[t], path)},
+			})
+		}
+		return bson.D{{Key: "$switch", Value: bson.D{
+			{Key: "branches", Value: branches},
+			{Key: "default", Value: v},
+		}}}
+	}
+	return v
+}
+
+// back renames the fields of a stored document, and of the documents nested
+// in it, according to their type.
+func (r typeRenamer) back(doc bson.D) interface{} {
+	return r.backValue(doc)
+}
+
+func (r typeRenamer) backValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		fields := r.fields[r.typeOf(v)]
+		out := make(bson.D, len(v))
+		for i, e := range v {
+			out[i] = bson.E{Key: rename(fields, e.Key), Value: r.backValue(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(v))
+		for i, e := range v {
+			out[i] = r.backValue(e)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"sort"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+// defaultCollection is the name of the collection holding the rules that are
+// not routed elsewhere.
+const defaultCollection = "casbin_rule"
+
+// CollectionSpec describes a rule collection.
+type CollectionSpec struct {
+	// Name is the name of the collection.
+	Name string
+	// Indexes are created on the collection in addition to the unique index
+	// on the rule values.
+	Indexes []mongo.IndexModel
+}
+
+// ruleIndex returns the unique index on the section, values and arity of a
+// rule.
+func (a *adapter) ruleIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    ruleIndexKeys(a.named),
+		Options: options.Index().SetUnique(true),
+	}
+}
+
+// ruleIndexKeys returns the keys of the unique index on the rules whose values
+// are stored under the names of named.
+func ruleIndexKeys(named map[string]map[string]string) bsonx.Doc {
+	keysDoc := bsonx.Doc{}
+
+	for _, k := range ruleIndexFields(named) {
+		keysDoc = keysDoc.Append(k, bsonx.Int32(1))
+	}
+
+	return keysDoc
+}
+
+// formerRuleIndexKeys returns the keys of the unique index created by the
+// versions that didn't index the arity of a rule.
+func formerRuleIndexKeys(named map[string]map[string]string) bsonx.Doc {
+	keysDoc := bsonx.Doc{}
+
+	for _, k := range ruleIndexFields(named) {
+		if k != "arity" {
+			keysDoc = keysDoc.Append(k, bsonx.Int32(1))
+		}
+	}
+
+	return keysDoc
+}
+
+// initCollections opens the rule collections of the layout and creates their
+// indexes. The default collection comes first. The names and indexes of the
+// collections are kept for backups.
+func (a *adapter) initCollections(ctx context.Context, db store.Database) error {
+	name := defaultCollection
+	if spec, ok := a.layout[""]; ok && spec.Name != "" {
+		name = spec.Name
+	}
+
+	a.collection = a.openCollection(db, name)
+	a.collections = []store.Collection{a.collection}
+	a.routes = make(map[string]store.Collection)
+	names := []string{name}
+	byName := map[string]store.Collection{name: a.collection}
+	indexes := map[string][]mongo.IndexModel{name: {a.ruleIndex()}}
+
+	keys := make([]string, 0, len(a.layout))
+	for key := range a.layout {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		spec := a.layout[key]
+		if key == "" {
+			indexes[name] = append(indexes[name], spec.Indexes...)
+			continue
+		}
+		coll, ok := byName[spec.Name]
+		if !ok {
+			coll = a.openCollection(db, spec.Name)
+			a.collections = append(a.collections, coll)
+			names = append(names, spec.Name)
+			byName[spec.Name] = coll
+			indexes[spec.Name] = []mongo.IndexModel{a.ruleIndex()}
+		}
+		indexes[spec.Name] = append(indexes[spec.Name], spec.Indexes...)
+		a.routes[key] = coll
+	}
+
+	a.names = names
+	a.indexes = indexes
+	for i, coll := range a.collections {
+		// The rule index of the collections used without named fields
+		// rejects the rules whose values are stored under other names. It
+		// is created again if the names don't change it.
+		if len(a.named) > 0 {
+			for _, keys := range []bsonx.Doc{ruleIndexKeys(nil), formerRuleIndexKeys(nil)} {
+				if err := coll.DropIndex(ctx, keys); err != nil {
+					return err
+				}
+			}
+		}
+		for _, index := range indexes[names[i]] {
+			if _, err := coll.CreateIndex(ctx, index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacyRuleIndex holds the keys of the unique index created by the versions
+// that didn't store the section of a rule.
+var legacyRuleIndex = bson.D{
+	{Key: "ptype", Value: int32(1)},
+	{Key: "v0", Value: int32(1)},
+	{Key: "v1", Value: int32(1)},
+	{Key: "v2", Value: int32(1)},
+	{Key: "v3", Value: int32(1)},
+	{Key: "v4", Value: int32(1)},
+	{Key: "v5", Value: int32(1)},
+}
+
+// MigratingAdapter is the interface for adapters that can upgrade the rules
+// stored by former versions.
+type MigratingAdapter interface {
+	persist.Adapter
+	// MigrateRules upgrades the stored rules and indexes in place. It may be
+	// run again, for example after an interruption.
+	MigrateRules(ctx context.Context) error
+}
+
+// MigrateRules upgrades the rules stored by former versions in every rule
+// collection. It reads the whole collections, so it is an explicit step
+// rather than part of creating the adapter.
+func (a *adapter) MigrateRules(ctx context.Context) error {
+	defer a.cache.Invalidate()
+
+	for _, coll := range a.collections {
+		if err := a.migrateRules(ctx, coll); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRules upgrades the rules stored by former versions: the section
+// inferred from the ptype and the arity of the values left once the trailing
+// empty ones are dropped, as they are on load, are stored in the rules without
+// them, and the former unique indexes are dropped, as the rule index replaces
+// them. A rule found to be stored already with its section and arity is
+// removed.
+func (a *adapter) migrateRules(ctx context.Context, coll store.Collection) error {
+	cursor, err := coll.Find(ctx, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "sec", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "arity", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}})
+	if err != nil {
+		return err
+	}
+	var lines []CasbinRule
+	for cursor.Next(ctx) {
+		var line CasbinRule
+		if err := cursor.Decode(&line); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		lines = append(lines, line)
+	}
+	if err := cursor.Err(); err != nil {
+		cursor.Close(ctx)
+		return err
+	}
+	if err := cursor.Close(ctx); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		id := bson.D{{Key: "_id", Value: line.ID}}
+		_, err := coll.UpdateOne(ctx, id, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "sec", Value: section(line)},
+			{Key: "arity", Value: len(ruleValues(line))},
+		}}})
+		if store.IsDuplicateKey(err) {
+			_, err = coll.DeleteOne(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := coll.DropIndex(ctx, legacyRuleIndex); err != nil {
+		return err
+	}
+	return coll.DropIndex(ctx, formerRuleIndexKeys(a.named))
+}
+
+// openCollection opens a rule collection, storing the fields under their
+// configured names and the values under the names of the model.
+func (a *adapter) openCollection(db store.Database, name string) store.Collection {
+	coll := db.Collection(name)
+	if len(a.fields) > 0 {
+		coll = store.RenameFields(coll, a.fields)
+	}
+	if len(a.named) > 0 {
+		coll = store.RenameFieldsByType(coll, "ptype", a.named)
+	}
+	return coll
+}
+
+// collectionFor returns the collection holding the rules of ptype in sec. A
+// collection configured for the ptype takes precedence over one configured for
+// the section.
+func (a *adapter) collectionFor(sec string, ptype string) store.Collection {
+	if coll, ok := a.routes[ptype]; ok {
+		return coll
+	}
+	if sec == "" {
+		sec = legacySection(ptype)
+	}
+	if coll, ok := a.routes[sec]; ok {
+		return coll
+	}
+	return a.collection
+}
+
+// sectionCollections returns the collections that may hold rules of sec, or
+// all collections if sec is empty.
+func (a *adapter) sectionCollections(sec string) []store.Collection {
+	if sec == "" {
+		return a.collections
+	}
+
+	wanted := map[store.Collection]bool{a.collectionFor(sec, sec): true}
+	for key, coll := range a.routes {
+		if legacySection(key) == sec {
+			wanted[coll] = true
+		}
+	}
+	var colls []store.Collection
+	for _, coll := range a.collections {
+		if wanted[coll] {
+			colls = append(colls, coll)
+		}
+	}
+	return colls
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestAdapter_Collections(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db, WithDiffSave(), WithCollections(map[string]CollectionSpec{
+		"p": {Name: "casbin_policy"},
+		"g": {
+			Name:    "casbin_grouping",
+			Indexes: []mongo.IndexModel{{Keys: bson.D{{Key: "v1", Value: 1}}}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rule stored before the layout was configured.
+	if _, err := db.Collection("casbin_rule").InsertOne(context.TODO(),
+		CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "data2_admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddPolicy("alice", "data1", "read")
+	e.AddPolicy("data2_admin", "data2", "read")
+	e.AddGroupingPolicy("bob", "data2_admin")
+
+	count := func(name string) int {
+		t.Helper()
+		cursor, err := db.Collection(name).Find(context.TODO(), bson.D{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for cursor.Next(context.TODO()) {
+			n++
+		}
+		return n
+	}
+	if p, g, rest := count("casbin_policy"), count("casbin_grouping"), count("casbin_rule"); p != 2 || g != 1 || rest != 1 {
+		t.Errorf("Collections hold %d policy, %d grouping and %d other rules, supposed to be 2, 1 and 1", p, g, rest)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected alice's grouping rule to be loaded from casbin_rule")
+	}
+
+	// A save moves the rule to the grouping collection.
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if g, rest := count("casbin_grouping"), count("casbin_rule"); g != 2 || rest != 0 {
+		t.Errorf("Collections hold %d grouping and %d other rules, supposed to be 2 and 0", g, rest)
+	}
+
+	// The unique index is created on every collection.
+	if err := a.AddPolicy("g", "g", []string{"bob", "data2_admin"}); err == nil {
+		t.Error("Expected AddPolicy() to fail for a duplicate rule")
+	}
+
+	e.RemoveFilteredGroupingPolicy(1, "data2_admin")
+	e.RemovePolicy("alice", "data1", "read")
+	if p, g := count("casbin_policy"), count("casbin_grouping"); p != 1 || g != 0 {
+		t.Errorf("Collections hold %d policy and %d grouping rules, supposed to be 1 and 0", p, g)
+	}
+
+	qa := a.(QueryAdapter)
+	if res, err := qa.FindPolicies(context.TODO(), PolicyQuery{Sec: "p"}, Page{}); err != nil || len(res.Rules) != 1 {
+		t.Errorf("Expected FindPolicies() to find 1 policy rule; got %v, %v", res.Rules, err)
+	}
+	if _, err := qa.FindPolicies(context.TODO(), PolicyQuery{}, Page{}); err == nil {
+		t.Error("Expected a query spanning several collections to be rejected")
+	}
+
+	stats, err := a.(StatsAdapter).Stats(context.TODO(), nil)
+	if err != nil || stats.Total != 1 {
+		t.Errorf("Expected Stats() to count 1 rule; got %+v, %v", stats, err)
+	}
+
+	if _, err := NewAdapterWithDatabase(db, WithCollections(map[string]CollectionSpec{"p": {}})); err == nil {
+		t.Error("Expected a collection without a name to be rejected")
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// defaultLockCollection is the default name of the lock collection.
+	defaultLockCollection = "casbin_lock"
+	// defaultLockTTL is the default duration of a lock lease.
+	defaultLockTTL = 30 * time.Second
+	// lockRetryDelay is the delay between attempts to take a held lock.
+	lockRetryDelay = 250 * time.Millisecond
+)
+
+// ErrLocked is returned when an operation needs the policy lock and another
+// owner holds it.
+var ErrLocked = errors.New("policy is locked by another owner")
+
+// LockOptions configures the distributed lock taken around SavePolicy and the
+// other bulk operations.
+type LockOptions struct {
+	// Collection is the collection holding the lock. The default is
+	// "casbin_lock".
+	Collection string
+	// Owner identifies this process in the lock document. The default is the
+	// host name and process ID.
+	Owner string
+	// TTL is the duration of a lease. Leases are renewed while the lock is
+	// held, so the TTL only bounds how long a crashed owner blocks the others.
+	// The default is 30 seconds.
+	TTL time.Duration
+	// Wait makes operations wait for the lock, until their timeout, instead of
+	// failing with ErrLocked.
+	Wait bool
+}
+
+// locker takes leases on a lock document. Each lease has its own token, so
+// two operations of the same process exclude each other too.
+type locker struct {
+	collection string
+	coll       store.Collection
+	// name is the _id of the lock document, the name of the default rule
+	// collection, so that the policies stored in other collections have
+	// their own lock.
+	name  string
+	owner string
+	ttl   time.Duration
+	wait  bool
+}
+
+func newLocker(opts LockOptions) (*locker, error) {
+	l := &locker{
+		collection: opts.Collection,
+		owner:      opts.Owner,
+		ttl:        opts.TTL,
+		wait:       opts.Wait,
+	}
+	if l.collection == "" {
+		l.collection = defaultLockCollection
+	}
+	if l.owner == "" {
+		host, _ := os.Hostname()
+		l.owner = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	if l.ttl == 0 {
+		l.ttl = defaultLockTTL
+	}
+	if l.ttl < 0 {
+		return nil, errors.New("lock TTL must be positive")
+	}
+	return l, nil
+}
+
+// lock takes the lock, waiting for it if configured to. It returns a context
+// derived from ctx that is cancelled if the lease is lost, and the function
+// releasing the lock.
+func (l *locker) lock(ctx context.Context) (context.Context, func(), error) {
+	if l == nil {
+		return ctx, func() {}, nil
+	}
+
+	token := primitive.NewObjectID().Hex()
+	for {
+		err := l.acquire(ctx, token)
+		if err == nil {
+			break
+		}
+		if err != ErrLocked || !l.wait {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("%w: %v", ErrLocked, ctx.Err())
+		case <-time.After(lockRetryDelay):
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		l.renew(ctx, token, done, cancel)
+	}()
+
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel()
+
+		rctx, rcancel := context.WithTimeout(context.Background(), l.ttl)
+		defer rcancel()
+		l.coll.DeleteOne(rctx, bson.D{{Key: "_id", Value: l.name}, {Key: "token", Value: token}})
+	}, nil
+}
+
+// acquire takes a lease if the lock is free or its last lease expired.
+func (l *locker) acquire(ctx context.Context, token string) error {
+	now := time.Now()
+	filter := bson.D{
+		{Key: "_id", Value: l.name},
+		{Key: "expires", Value: bson.D{{Key: "$lt", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "owner", Value: l.owner},
+		{Key: "token", Value: token},
+		{Key: "acquired", Value: now},
+		{Key: "expires", Value: now.Add(l.ttl)},
+	}}}
+
+	// A held lock doesn't match the filter, so the upsert collides with it.
+	_, err := l.coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if store.IsDuplicateKey(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+// renew extends the lease every third of its TTL until done is closed. If the
+// lease was lost, cancel is called.
+func (l *locker) renew(ctx context.Context, token string, done <-chan struct{}, cancel context.CancelFunc) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := l.coll.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: l.name}, {Key: "token", Value: token}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "expires", Value: time.Now().Add(l.ttl)}}}})
+		if err == nil && res.MatchedCount == 0 {
+			cancel()
+			return
+		}
+	}
+}
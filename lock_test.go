@@ -0,0 +1,105 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_Lock(t *testing.T) {
+	db := memory.NewDatabase()
+	holder, err := NewAdapterWithDatabase(db, WithLock(LockOptions{Owner: "holder", TTL: 60 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewAdapterWithDatabase(db, 200*time.Millisecond, WithLock(LockOptions{Owner: "other"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiter, err := NewAdapterWithDatabase(db, 200*time.Millisecond, WithLock(LockOptions{Owner: "waiter", Wait: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(holder.(*adapter))
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lease outlives its TTL while it is renewed.
+	_, unlock, err := holder.(*adapter).locker.lock(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	var lock struct {
+		Owner string `bson:"owner"`
+	}
+	if err := db.Collection("casbin_lock").FindOne(context.TODO(), bson.M{"_id": "casbin_rule"}).Decode(&lock); err != nil || lock.Owner != "holder" {
+		t.Fatalf("Expected the lock to be held by holder; got %+v, %v", lock, err)
+	}
+	if err := e.SavePolicy(); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected SavePolicy() to fail fast with ErrLocked; got %v", err)
+	}
+	if err := waiter.RemoveFilteredPolicy("p", "p", 0, "bob"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected RemoveFilteredPolicy() to give up waiting with ErrLocked; got %v", err)
+	}
+
+	unlock()
+	if err := e.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful once the lock is released; got %v", err)
+	}
+
+	// The lock of a crashed owner can be taken once its lease expired.
+	if _, err := db.Collection("casbin_lock").InsertOne(context.TODO(), bson.M{
+		"_id": "casbin_rule", "owner": "crashed", "expires": time.Now().Add(-time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to take an expired lock; got %v", err)
+	}
+
+	// An adapter using another rule collection takes its own lock.
+	_, unlock, err = holder.(*adapter).locker.lock(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	tenant, err := NewAdapterWithDatabase(db, WithLock(LockOptions{Owner: "tenant"}),
+		WithCollections(map[string]CollectionSpec{"": {Name: "tenant_rule"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.RemoveFilteredPolicy("p", "p", 0, "bob"); err != nil {
+		t.Errorf("Expected the lock of another rule collection not to be held; got %v", err)
+	}
+	if tenant.(*adapter).locker.name != "tenant_rule" {
+		t.Errorf("Expected the lock to be named after tenant_rule; got %q", tenant.(*adapter).locker.name)
+	}
+
+	if _, err := NewAdapterWithDatabase(db, WithLock(LockOptions{TTL: -time.Second})); err == nil {
+		t.Error("Expected a negative TTL to be rejected")
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Aggregate runs an aggregation pipeline on the collection. The $match,
+// $group, $sort, $skip, $limit, $count, $facet and $graphLookup stages are
+// supported, with the $sum, $first, $push and $addToSet accumulators and the
+// $switch and $eq expressions.
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (store.Cursor, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	docs := make([]bson.D, len(c.docs))
+	for i, doc := range c.docs {
+		docs[i] = copyDoc(doc)
+	}
+	c.mu.RUnlock()
+
+	if docs, err = runPipeline(c.db, docs, stages); err != nil {
+		return nil, err
+	}
+	return &cursor{docs: docs}, nil
+}
+
+// toPipeline converts any of the pipeline types accepted by the driver to a
+// list of stages.
+func toPipeline(pipeline interface{}) ([]bson.D, error) {
+	doc, err := toDoc(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return nil, err
+	}
+	v, _ := lookup(doc, "pipeline")
+	a, ok := v.(bson.A)
+	if !ok {
+		return nil, errors.New("pipeline must be an array")
+	}
+	stages := make([]bson.D, 0, len(a))
+	for _, s := range a {
+		stage, ok := s.(bson.D)
+		if !ok {
+			return nil, errors.New("pipeline stages must be documents")
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// runPipeline runs stages on docs. Stages reading other collections look them
+// up in db.
+func runPipeline(db *Database, docs []bson.D, stages []bson.D) ([]bson.D, error) {
+	for _, stage := range stages {
+		if len(stage) != 1 {
+			return nil, errors.New("a pipeline stage specification object must contain exactly one field")
+		}
+		var err error
+		if docs, err = runStage(db, docs, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func runStage(db *Database, docs []bson.D, stage bson.E) ([]bson.D, error) {
+	switch stage.Key {
+	case "$match":
+		f, ok := asDoc(stage.Value)
+		if !ok {
+			return nil, errors.New("the match filter must be an expression in an object")
+		}
+		var out []bson.D
+		for _, doc := range docs {
+			ok, err := match(doc, f)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, doc)
+			}
+		}
+		return out, nil
+	case "$group":
+		spec, ok := asDoc(stage.Value)
+		if !ok {
+			return nil, errors.New("a group's fields must be specified in an object")
+		}
+		return group(docs, spec)
+	case "$sort":
+		keys, ok := asDoc(stage.Value)
+		if !ok || len(keys) == 0 {
+			return nil, errors.New("$sort key specification must be a nonempty object")
+		}
+		sortDocs(docs, keys)
+		return docs, nil
+	case "$skip", "$limit":
+		n, ok := number(stage.Value)
+		if !ok || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number", stage.Key)
+		}
+		if stage.Key == "$skip" {
+			if int(n) >= len(docs) {
+				return nil, nil
+			}
+			return docs[int(n):], nil
+		}
+		if int(n) < len(docs) {
+			return docs[:int(n)], nil
+		}
+		return docs, nil
+	case "$count":
+		name, ok := stage.Value.(string)
+		if !ok || name == "" || strings.HasPrefix(name, "$") {
+			return nil, errors.New("the count field must be a non-empty string not starting with '$'")
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return []bson.D{{{Key: name, Value: int32(len(docs))}}}, nil
+	case "$facet":
+		spec, ok := asDoc(stage.Value)
+		if !ok {
+			return nil, errors.New("$facet must be an object")
+		}
+		result := bson.D{}
+		for _, f := range spec {
+			stages, err := toPipeline(f.Value)
+			if err != nil {
+				return nil, err
+			}
+			input := make([]bson.D, len(docs))
+			copy(input, docs)
+			out, err := runPipeline(db, input, stages)
+			if err != nil {
+				return nil, err
+			}
+			values := make(bson.A, 0, len(out))
+			for _, doc := range out {
+				values = append(values, doc)
+			}
+			result = append(result, bson.E{Key: f.Key, Value: values})
+		}
+		return []bson.D{result}, nil
+	case "$graphLookup":
+		spec, ok := asDoc(stage.Value)
+		if !ok {
+			return nil, errors.New("the argument to $graphLookup must be an object")
+		}
+		return graphLookup(db, docs, spec)
+	}
+	return nil, fmt.Errorf("unrecognized pipeline stage name: '%s'", stage.Key)
+}
+
+// group implements the $group stage.
+func group(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var idExpr interface{}
+	var accumulators bson.D
+	hasID := false
+	for _, f := range spec {
+		if f.Key == "_id" {
+			idExpr, hasID = f.Value, true
+			continue
+		}
+		acc, ok := asDoc(f.Value)
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("the field '%s' must be an accumulator object", f.Key)
+		}
+		switch acc[0].Key {
+		case "$sum", "$first", "$push", "$addToSet":
+		default:
+			return nil, fmt.Errorf("unknown group operator '%s'", acc[0].Key)
+		}
+		accumulators = append(accumulators, bson.E{Key: f.Key, Value: acc[0]})
+	}
+	if !hasID {
+		return nil, errors.New("a group specification must include an _id")
+	}
+
+	var keys []string
+	groups := make(map[string]bson.D)
+	for _, doc := range docs {
+		id := evaluate(doc, idExpr)
+		k := fmt.Sprintf("%#v", bson.D{{Key: "", Value: id}})
+		out, ok := groups[k]
+		if !ok {
+			keys = append(keys, k)
+			out = bson.D{{Key: "_id", Value: id}}
+		}
+		for _, a := range accumulators {
+			op := a.Value.(bson.E)
+			v := evaluate(doc, op.Value)
+			cur, seen := lookup(out, a.Key)
+			switch op.Key {
+			case "$sum":
+				if _, ok := number(v); !ok {
+					v = int32(0)
+				}
+				sum, err := add(cur, v)
+				if err != nil {
+					return nil, err
+				}
+				out = set(out, a.Key, sum)
+			case "$first":
+				if !seen {
+					out = set(out, a.Key, v)
+				}
+			case "$push", "$addToSet":
+				values, _ := cur.(bson.A)
+				if op.Key == "$addToSet" && contains(values, v) {
+					out = set(out, a.Key, values)
+					continue
+				}
+				out = set(out, a.Key, append(values, v))
+			}
+		}
+		groups[k] = out
+	}
+
+	out := make([]bson.D, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, groups[k])
+	}
+	return out, nil
+}
+
+// graphLookup implements the $graphLookup stage.
+func graphLookup(db *Database, docs []bson.D, spec bson.D) ([]bson.D, error) {
+	var from, connectFrom, connectTo, as, depthField string
+	for _, f := range []struct {
+		name     string
+		value    *string
+		required bool
+	}{
+		{"from", &from, true},
+		{"connectFromField", &connectFrom, true},
+		{"connectToField", &connectTo, true},
+		{"as", &as, true},
+		{"depthField", &depthField, false},
+	} {
+		v, ok := lookup(spec, f.name)
+		if !ok && !f.required {
+			continue
+		}
+		if *f.value, ok = v.(string); !ok || *f.value == "" {
+			return nil, fmt.Errorf("$graphLookup requires '%s' to be a non-empty string", f.name)
+		}
+	}
+	startWith, ok := lookup(spec, "startWith")
+	if !ok {
+		return nil, errors.New("$graphLookup requires a 'startWith' expression")
+	}
+	maxDepth := -1.0
+	if v, ok := lookup(spec, "maxDepth"); ok {
+		if maxDepth, ok = number(v); !ok || maxDepth < 0 {
+			return nil, errors.New("maxDepth must be a non-negative number")
+		}
+	}
+	var restrict bson.D
+	if v, ok := lookup(spec, "restrictSearchWithMatch"); ok {
+		if restrict, ok = asDoc(v); !ok {
+			return nil, errors.New("restrictSearchWithMatch must be an object")
+		}
+	}
+	if db == nil {
+		return nil, errors.New("$graphLookup needs a database")
+	}
+
+	target := db.Collection(from).(*Collection)
+	target.mu.RLock()
+	candidates := make([]bson.D, 0, len(target.docs))
+	for _, doc := range target.docs {
+		ok, err := match(doc, restrict)
+		if err != nil {
+			target.mu.RUnlock()
+			return nil, err
+		}
+		if ok {
+			candidates = append(candidates, copyDoc(doc))
+		}
+	}
+	target.mu.RUnlock()
+
+	for i, doc := range docs {
+		found := bson.A{}
+		seen := make(map[string]bool)
+		frontier := elements(evaluate(doc, startWith))
+		for depth := 0; len(frontier) > 0 && (maxDepth < 0 || float64(depth) <= maxDepth); depth++ {
+			var next bson.A
+			for _, c := range candidates {
+				v, _ := lookup(c, connectTo)
+				if !overlaps(frontier, elements(v)) {
+					continue
+				}
+				id, _ := lookup(c, "_id")
+				k := fmt.Sprintf("%#v", bson.D{{Key: "", Value: id}})
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+
+				out := copyDoc(c)
+				if depthField != "" {
+					out = set(out, depthField, int64(depth))
+				}
+				found = append(found, out)
+				linked, _ := lookup(c, connectFrom)
+				next = append(next, elements(linked)...)
+			}
+			frontier = next
+		}
+		docs[i] = set(doc, as, found)
+	}
+	return docs, nil
+}
+
+// elements returns the elements of v if it is an array, or v itself.
+func elements(v interface{}) bson.A {
+	if a, ok := v.(bson.A); ok {
+		return a
+	}
+	return bson.A{v}
+}
+
+// overlaps reports whether a and b have an element in common.
+func overlaps(a, b bson.A) bool {
+	for _, v := range b {
+		if contains(a, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns the value of an expression: a field path such as "$v0", a
+// $switch or $eq operator, a document of expressions, or a literal.
+func evaluate(doc bson.D, expr interface{}) interface{} {
+	switch e := expr.(type) {
+	case string:
+		if strings.HasPrefix(e, "$") {
+			v, _ := lookup(doc, e[1:])
+			return v
+		}
+	case bson.D:
+		if len(e) == 1 {
+			switch e[0].Key {
+			case "$switch":
+				return evaluateSwitch(doc, e[0].Value)
+			case "$eq":
+				args, ok := e[0].Value.(bson.A)
+				return ok && len(args) == 2 && equal(evaluate(doc, args[0]), evaluate(doc, args[1]))
+			}
+		}
+		out := make(bson.D, 0, len(e))
+		for _, f := range e {
+			out = append(out, bson.E{Key: f.Key, Value: evaluate(doc, f.Value)})
+		}
+		return out
+	}
+	return expr
+}
+
+// evaluateSwitch returns the value of the first branch of a $switch whose
+// case is true, or its default.
+func evaluateSwitch(doc bson.D, spec interface{}) interface{} {
+	d, _ := asDoc(spec)
+	branches, _ := lookup(d, "branches")
+	a, _ := branches.(bson.A)
+	for _, b := range a {
+		branch, _ := asDoc(b)
+		c, _ := lookup(branch, "case")
+		if ok, _ := evaluate(doc, c).(bool); ok {
+			then, _ := lookup(branch, "then")
+			return evaluate(doc, then)
+		}
+	}
+	def, _ := lookup(d, "default")
+	return evaluate(doc, def)
+}
+
+func contains(values bson.A, v interface{}) bool {
+	for _, e := range values {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,485 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// toDoc converts any BSON-marshalable value into a bson.D, so that filters,
+// updates and documents given as structs, maps or documents are all handled
+// in the same representation. Documents are converted too, so that nested Go
+// values such as []string become the BSON types the server would see.
+func toDoc(v interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// copyDoc returns a deep copy of d.
+func copyDoc(d bson.D) bson.D {
+	raw, err := bson.Marshal(d)
+	if err != nil {
+		panic(err)
+	}
+	var c bson.D
+	if err := bson.Unmarshal(raw, &c); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// asDoc reports whether v is an embedded document and returns it as a bson.D.
+func asDoc(v interface{}) (bson.D, bool) {
+	switch d := v.(type) {
+	case bson.D:
+		return d, true
+	case bson.M:
+		out := make(bson.D, 0, len(d))
+		for k, e := range d {
+			out = append(out, bson.E{Key: k, Value: e})
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// lookup returns the value stored at key, which may be a dotted path.
+func lookup(doc bson.D, key string) (interface{}, bool) {
+	parts := strings.SplitN(key, ".", 2)
+	for _, e := range doc {
+		if e.Key != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			return e.Value, true
+		}
+		sub, ok := asDoc(e.Value)
+		if !ok {
+			return nil, false
+		}
+		return lookup(sub, parts[1])
+	}
+	return nil, false
+}
+
+// set stores v at key, replacing an existing value or appending a new field.
+func set(doc bson.D, key string, v interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			doc[i].Value = v
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: v})
+}
+
+// setPath stores v at key, which may be a dotted path whose missing parts are
+// created as embedded documents. Like MongoDB, it fails if a part of the path
+// holds another value than a document.
+func setPath(doc bson.D, key string, v interface{}) (bson.D, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 1 {
+		return set(doc, key, v), nil
+	}
+	for i, e := range doc {
+		if e.Key != parts[0] {
+			continue
+		}
+		sub, ok := asDoc(e.Value)
+		if !ok {
+			return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+				Code:    pathNotViableCode,
+				Message: fmt.Sprintf("Cannot create field '%s' in element {%s: %v}", parts[1], e.Key, e.Value),
+			}}}
+		}
+		sub, err := setPath(copyDoc(sub), parts[1], v)
+		if err != nil {
+			return nil, err
+		}
+		doc[i].Value = sub
+		return doc, nil
+	}
+	sub, err := setPath(bson.D{}, parts[1], v)
+	if err != nil {
+		return nil, err
+	}
+	return append(doc, bson.E{Key: parts[0], Value: sub}), nil
+}
+
+// unsetPath removes key, which may be a dotted path, from doc.
+func unsetPath(doc bson.D, key string) bson.D {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) == 1 {
+		return unset(doc, key)
+	}
+	for i, e := range doc {
+		if e.Key != parts[0] {
+			continue
+		}
+		if sub, ok := asDoc(e.Value); ok {
+			doc[i].Value = unsetPath(copyDoc(sub), parts[1])
+		}
+		return doc
+	}
+	return doc
+}
+
+// unset removes key from doc.
+func unset(doc bson.D, key string) bson.D {
+	for i, e := range doc {
+		if e.Key == key {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+	}
+	return doc
+}
+
+// match reports whether doc satisfies the query filter.
+func match(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("%s must be a nonempty array", e.Key)
+		}
+		for _, c := range clauses {
+			sub, ok := asDoc(c)
+			if !ok {
+				return false, fmt.Errorf("%s argument's entries must be objects", e.Key)
+			}
+			m, err := match(doc, sub)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !m:
+				return false, nil
+			case e.Key == "$or" && m:
+				return true, nil
+			case e.Key == "$nor" && m:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("unknown top level operator: %s", e.Key)
+	}
+
+	v, exists := lookup(doc, e.Key)
+	if ops, ok := asDoc(e.Value); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+		return matchOperators(v, exists, ops)
+	}
+	return matchValue(v, exists, e.Value)
+}
+
+// matchValue implements implicit equality, including regular expressions and
+// the null-matches-missing rule.
+func matchValue(v interface{}, exists bool, cond interface{}) (bool, error) {
+	if re, ok := cond.(primitive.Regex); ok {
+		return matchRegex(v, re.Pattern, re.Options)
+	}
+	if cond == nil {
+		return !exists || v == nil, nil
+	}
+	if !exists {
+		return false, nil
+	}
+	if arr, ok := v.(bson.A); ok {
+		for _, item := range arr {
+			if equal(item, cond) {
+				return true, nil
+			}
+		}
+	}
+	return equal(v, cond), nil
+}
+
+func matchOperators(v interface{}, exists bool, ops bson.D) (bool, error) {
+	var regexOptions string
+	for _, op := range ops {
+		if op.Key == "$options" {
+			regexOptions, _ = op.Value.(string)
+		}
+	}
+
+	for _, op := range ops {
+		var ok bool
+		var err error
+		switch op.Key {
+		case "$eq":
+			ok, err = matchValue(v, exists, op.Value)
+		case "$ne":
+			ok, err = matchValue(v, exists, op.Value)
+			ok = !ok
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = exists && compareOp(op.Key, v, op.Value)
+		case "$in", "$nin":
+			list, isList := op.Value.(bson.A)
+			if !isList {
+				return false, fmt.Errorf("%s needs an array", op.Key)
+			}
+			for _, item := range list {
+				if ok, err = matchValue(v, exists, item); err != nil || ok {
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			ok = exists == truthy(op.Value)
+		case "$type":
+			alias, isAlias := op.Value.(string)
+			if !isAlias {
+				return false, fmt.Errorf("$type needs a type alias")
+			}
+			ok = exists && typeAlias(v) == alias
+		case "$regex":
+			switch re := op.Value.(type) {
+			case string:
+				ok, err = matchRegex(v, re, regexOptions)
+			case primitive.Regex:
+				ok, err = matchRegex(v, re.Pattern, re.Options+regexOptions)
+			default:
+				return false, fmt.Errorf("$regex has to be a string")
+			}
+		case "$options":
+			continue
+		case "$not":
+			if re, isRegex := op.Value.(primitive.Regex); isRegex {
+				ok, err = matchRegex(v, re.Pattern, re.Options)
+			} else if sub, isDoc := asDoc(op.Value); isDoc {
+				ok, err = matchOperators(v, exists, sub)
+			} else {
+				return false, fmt.Errorf("$not needs a regex or a document")
+			}
+			ok = !ok
+		default:
+			return false, fmt.Errorf("unknown operator: %s", op.Key)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchRegex(v interface{}, pattern, options string) (bool, error) {
+	s, ok := v.(string)
+	if !ok {
+		return false, nil
+	}
+	var flags string
+	for _, o := range options {
+		if strings.ContainsRune("ims", o) {
+			flags += string(o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+	if f, ok := number(v); ok {
+		return f != 0
+	}
+	return true
+}
+
+// number converts any BSON numeric type to a float64.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	a, b = dateTime(a), dateTime(b)
+	if fa, ok := number(a); ok {
+		fb, ok := number(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compareOp(op string, a, b interface{}) bool {
+	if typeOrder(a) != typeOrder(b) {
+		return false
+	}
+	c := compare(a, b)
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	}
+	return c <= 0
+}
+
+// typeOrder returns the position of v's type in the BSON comparison order.
+func typeOrder(v interface{}) int {
+	if _, ok := number(v); ok {
+		return 2
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case bson.D, bson.M:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime, time.Time:
+		return 9
+	}
+	return 10
+}
+
+// typeAlias returns the alias of v's BSON type, as matched by $type.
+func typeAlias(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case bson.D, bson.M:
+		return "object"
+	case bson.A:
+		return "array"
+	case primitive.Binary:
+		return "binData"
+	case primitive.ObjectID:
+		return "objectId"
+	case bool:
+		return "bool"
+	case primitive.DateTime, time.Time:
+		return "date"
+	}
+	return ""
+}
+
+// dateTime converts a time.Time, which only appears in filters that were not
+// marshalled, to the BSON date it is stored as.
+func dateTime(v interface{}) interface{} {
+	if t, ok := v.(time.Time); ok {
+		return primitive.NewDateTimeFromTime(t)
+	}
+	return v
+}
+
+// compare orders two values following the BSON comparison order.
+func compare(a, b interface{}) int {
+	a, b = dateTime(a), dateTime(b)
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return ta - tb
+	}
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(av, b.(string))
+	case primitive.ObjectID:
+		bv := b.(primitive.ObjectID)
+		return bytes.Compare(av[:], bv[:])
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case bv:
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		if bv, ok := b.(primitive.DateTime); ok {
+			return int(av - bv)
+		}
+	}
+	if fa, ok := number(a); ok {
+		fb, _ := number(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
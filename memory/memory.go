@@ -0,0 +1,868 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory provides an in-memory storage backend for the MongoDB adapter,
+// so that code using the adapter can be tested without a MongoDB server:
+//
+//	a, err := mongodbadapter.NewAdapterWithDatabase(memory.NewDatabase())
+//
+// The backend supports the query and update operators used by the adapter,
+// enforces unique indexes and returns the same error types as the driver.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	duplicateKeyCode = 11000
+	// pathNotViableCode is the code of an update creating a field inside a
+	// value that isn't a document.
+	pathNotViableCode = 28
+	// immutableFieldCode is the code of an update changing the _id of a
+	// document.
+	immutableFieldCode = 66
+)
+
+// Database is an in-memory database holding a set of collections.
+type Database struct {
+	mu          sync.Mutex
+	collections map[string]*Collection
+}
+
+// NewDatabase returns an empty in-memory database.
+func NewDatabase() *Database {
+	return &Database{collections: make(map[string]*Collection)}
+}
+
+// Collection returns the named collection, creating it if it doesn't exist.
+func (d *Database) Collection(name string) store.Collection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c, ok := d.collections[name]
+	if !ok {
+		c = &Collection{name: name, db: d}
+		d.collections[name] = c
+	}
+	return c
+}
+
+// RunCommand runs a database command. Only the ping, buildInfo and isMaster
+// commands are supported; the backend reports itself as a standalone server
+// with version "memory".
+func (d *Database) RunCommand(ctx context.Context, runCommand interface{},
+	opts ...*options.RunCmdOptions) store.SingleResult {
+
+	if err := ctx.Err(); err != nil {
+		return &singleResult{err: err}
+	}
+	cmd, err := toDoc(runCommand)
+	if err != nil {
+		return &singleResult{err: err}
+	}
+	if len(cmd) == 0 {
+		return &singleResult{err: errors.New("empty command")}
+	}
+
+	switch cmd[0].Key {
+	case "ping":
+		return &singleResult{doc: bson.D{{Key: "ok", Value: 1.0}}}
+	case "buildInfo", "buildinfo":
+		return &singleResult{doc: bson.D{{Key: "version", Value: "memory"}, {Key: "ok", Value: 1.0}}}
+	case "isMaster", "ismaster":
+		return &singleResult{doc: bson.D{{Key: "ismaster", Value: true}, {Key: "ok", Value: 1.0}}}
+	}
+	return &singleResult{err: mongo.CommandError{
+		Code:    59,
+		Name:    "CommandNotFound",
+		Message: fmt.Sprintf("no such command: '%s'", cmd[0].Key),
+	}}
+}
+
+// WithTransaction runs fn and restores the documents of every collection if
+// it fails. Unlike a server transaction, the changes made by fn are visible to
+// other operations before it returns.
+func (d *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	d.mu.Lock()
+	snapshot := make(map[*Collection][]bson.D, len(d.collections))
+	for _, c := range d.collections {
+		c.mu.RLock()
+		snapshot[c] = append([]bson.D(nil), c.docs...)
+		c.mu.RUnlock()
+	}
+	d.mu.Unlock()
+
+	err := fn(ctx)
+	if err == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.collections {
+		c.mu.Lock()
+		c.docs = snapshot[c]
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// index is a secondary index definition.
+type index struct {
+	name   string
+	keys   bson.D
+	unique bool
+}
+
+// Collection is an in-memory collection.
+type Collection struct {
+	name    string
+	db      *Database
+	mu      sync.RWMutex
+	docs    []bson.D
+	indexes []index
+	streams map[*changeStream]struct{}
+	seq     int64
+}
+
+// InsertOne inserts a single document into the collection.
+func (c *Collection) InsertOne(ctx context.Context, document interface{},
+	opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := c.insert(document)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// InsertMany inserts the provided documents. Like the driver, inserts are
+// ordered by default and stop at the first error.
+func (c *Collection) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+
+	if len(documents) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ordered := true
+	if o := options.MergeInsertManyOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := &mongo.InsertManyResult{}
+	var writeErrors []mongo.BulkWriteError
+	for i, document := range documents {
+		id, err := c.insert(document)
+		if err != nil {
+			we, ok := err.(mongo.WriteException)
+			if !ok {
+				return nil, err
+			}
+			writeErrors = append(writeErrors, mongo.BulkWriteError{
+				WriteError: mongo.WriteError{Index: i, Code: we.WriteErrors[0].Code, Message: we.WriteErrors[0].Message},
+			})
+			if ordered {
+				break
+			}
+			continue
+		}
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+	if len(writeErrors) > 0 {
+		return result, mongo.BulkWriteException{WriteErrors: writeErrors}
+	}
+	return result, nil
+}
+
+// DeleteOne deletes at most one document matching filter.
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(ctx, filter, true)
+}
+
+// DeleteMany deletes all documents matching filter.
+func (c *Collection) DeleteMany(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(ctx, filter, false)
+}
+
+func (c *Collection) delete(ctx context.Context, filter interface{}, one bool) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deleted, err := c.deleteMatching(f, one)
+	if err != nil {
+		return nil, err
+	}
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+// deleteMatching removes the documents matching f, or only the first one if
+// one is set. The caller must hold the write lock.
+func (c *Collection) deleteMatching(f bson.D, one bool) (int64, error) {
+	var deleted int64
+	kept := make([]bson.D, 0, len(c.docs))
+	for _, doc := range c.docs {
+		if !one || deleted == 0 {
+			ok, err := match(doc, f)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				deleted++
+				id, _ := lookup(doc, "_id")
+				c.notify("delete", id, nil)
+				continue
+			}
+		}
+		kept = append(kept, doc)
+	}
+	c.docs = kept
+	return deleted, nil
+}
+
+// UpdateOne updates at most one document matching filter.
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUpdate(u); err != nil {
+		return nil, err
+	}
+	upsert := false
+	if o := options.MergeUpdateOptions(opts...); o.Upsert != nil {
+		upsert = *o.Upsert
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, _, _, err := c.updateMatching(f, u, upsert)
+	return result, err
+}
+
+// updateMatching applies u to the first document matching f, inserting a new
+// document if none matches and upsert is set. It also returns the document
+// before and after the update; before is nil for an upsert and both are nil if
+// nothing matched. The caller must hold the write lock.
+func (c *Collection) updateMatching(f, u bson.D, upsert bool) (*mongo.UpdateResult, bson.D, bson.D, error) {
+	for i, doc := range c.docs {
+		ok, err := match(doc, f)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		updated, err := applyUpdate(copyDoc(doc), u, false)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		oldID, _ := lookup(doc, "_id")
+		if newID, _ := lookup(updated, "_id"); !equal(oldID, newID) {
+			return nil, nil, nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+				Code:    immutableFieldCode,
+				Message: "Performing an update on the path '_id' would modify the immutable field '_id'",
+			}}}
+		}
+		if err := c.checkUnique(updated, i); err != nil {
+			return nil, nil, nil, err
+		}
+		result := &mongo.UpdateResult{MatchedCount: 1}
+		if !equal(updated, doc) {
+			c.docs[i] = updated
+			result.ModifiedCount = 1
+			id, _ := lookup(updated, "_id")
+			c.notify("update", id, nil)
+		}
+		return result, copyDoc(doc), copyDoc(updated), nil
+	}
+
+	if !upsert {
+		return &mongo.UpdateResult{}, nil, nil, nil
+	}
+	doc := bson.D{}
+	for _, e := range f {
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+		if ops, ok := asDoc(e.Value); ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$") {
+			continue
+		}
+		var err error
+		if doc, err = setPath(doc, e.Key, e.Value); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	doc, err := applyUpdate(doc, u, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	id, err := c.insert(doc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, ok := lookup(doc, "_id"); !ok {
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil, doc, nil
+}
+
+// FindOneAndUpdate updates the first document matching filter and returns it,
+// as it was before the update unless the ReturnDocument option is After.
+func (c *Collection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) store.SingleResult {
+
+	if err := ctx.Err(); err != nil {
+		return &singleResult{err: err}
+	}
+	f, err := toDoc(filter)
+	if err != nil {
+		return &singleResult{err: err}
+	}
+	u, err := toDoc(update)
+	if err != nil {
+		return &singleResult{err: err}
+	}
+	if err := checkUpdate(u); err != nil {
+		return &singleResult{err: err}
+	}
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, before, after, err := c.updateMatching(f, u, o.Upsert != nil && *o.Upsert)
+	if err != nil {
+		return &singleResult{err: err}
+	}
+	doc := before
+	if o.ReturnDocument != nil && *o.ReturnDocument == options.After {
+		doc = after
+	}
+	if doc == nil {
+		return &singleResult{err: mongo.ErrNoDocuments}
+	}
+	return &singleResult{doc: doc}
+}
+
+// checkUpdate verifies that u is an update document rather than a
+// replacement.
+func checkUpdate(u bson.D) error {
+	if len(u) == 0 || !strings.HasPrefix(u[0].Key, "$") {
+		return errors.New("update document must contain key beginning with '$'")
+	}
+	return nil
+}
+
+// BulkWrite performs the given insert, update and delete operations. Like the
+// driver, operations are ordered by default and stop at the first error.
+func (c *Collection) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ordered := true
+	if o := options.MergeBulkWriteOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+	var writeErrors []mongo.BulkWriteError
+	for i, model := range models {
+		err := c.apply(model, int64(i), result)
+		if err == nil {
+			continue
+		}
+		we, ok := err.(mongo.WriteException)
+		if !ok {
+			return nil, err
+		}
+		writeErrors = append(writeErrors, mongo.BulkWriteError{
+			WriteError: mongo.WriteError{Index: i, Code: we.WriteErrors[0].Code, Message: we.WriteErrors[0].Message},
+			Request:    model,
+		})
+		if ordered {
+			break
+		}
+	}
+	if len(writeErrors) > 0 {
+		return result, mongo.BulkWriteException{WriteErrors: writeErrors}
+	}
+	return result, nil
+}
+
+// apply performs a single bulk write operation and accumulates its outcome in
+// result. The caller must hold the write lock.
+func (c *Collection) apply(model mongo.WriteModel, i int64, result *mongo.BulkWriteResult) error {
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		if _, err := c.insert(m.Document); err != nil {
+			return err
+		}
+		result.InsertedCount++
+	case *mongo.DeleteOneModel:
+		return c.applyDelete(m.Filter, true, result)
+	case *mongo.DeleteManyModel:
+		return c.applyDelete(m.Filter, false, result)
+	case *mongo.UpdateOneModel:
+		f, err := toDoc(m.Filter)
+		if err != nil {
+			return err
+		}
+		u, err := toDoc(m.Update)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdate(u); err != nil {
+			return err
+		}
+		res, _, _, err := c.updateMatching(f, u, m.Upsert != nil && *m.Upsert)
+		if err != nil {
+			return err
+		}
+		result.MatchedCount += res.MatchedCount
+		result.ModifiedCount += res.ModifiedCount
+		if res.UpsertedID != nil {
+			result.UpsertedCount++
+			result.UpsertedIDs[i] = res.UpsertedID
+		}
+	default:
+		return fmt.Errorf("unsupported write model %T", model)
+	}
+	return nil
+}
+
+func (c *Collection) applyDelete(filter interface{}, one bool, result *mongo.BulkWriteResult) error {
+	f, err := toDoc(filter)
+	if err != nil {
+		return err
+	}
+	deleted, err := c.deleteMatching(f, one)
+	if err != nil {
+		return err
+	}
+	result.DeletedCount += deleted
+	return nil
+}
+
+// applyUpdate applies the update operators in u to doc.
+func applyUpdate(doc bson.D, u bson.D, inserting bool) (bson.D, error) {
+	for _, op := range u {
+		fields, ok := asDoc(op.Value)
+		if !ok {
+			// Structs are marshalled like the driver does.
+			var err error
+			if fields, err = toDoc(op.Value); err != nil {
+				return nil, fmt.Errorf("modifiers operate on fields but we found a non-document for %s", op.Key)
+			}
+		}
+		for _, f := range fields {
+			var err error
+			switch op.Key {
+			case "$set":
+				doc, err = setPath(doc, f.Key, f.Value)
+			case "$setOnInsert":
+				if inserting {
+					doc, err = setPath(doc, f.Key, f.Value)
+				}
+			case "$unset":
+				doc = unsetPath(doc, f.Key)
+			case "$inc":
+				cur, _ := lookup(doc, f.Key)
+				sum, err := add(cur, f.Value)
+				if err != nil {
+					return nil, err
+				}
+				doc, err = setPath(doc, f.Key, sum)
+				if err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("unknown modifier: %s", op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// add implements $inc, keeping the widest integer type of its operands.
+func add(cur, inc interface{}) (interface{}, error) {
+	if cur == nil {
+		cur = int32(0)
+	}
+	switch c := cur.(type) {
+	case int32:
+		if i, ok := inc.(int32); ok {
+			return c + i, nil
+		}
+		if i, ok := inc.(int64); ok {
+			return int64(c) + i, nil
+		}
+	case int64:
+		if i, ok := inc.(int32); ok {
+			return c + int64(i), nil
+		}
+		if i, ok := inc.(int64); ok {
+			return c + i, nil
+		}
+	}
+	a, ok1 := number(cur)
+	b, ok2 := number(inc)
+	if !ok1 || !ok2 {
+		return nil, errors.New("cannot apply $inc to a value of non-numeric type")
+	}
+	return a + b, nil
+}
+
+// Find returns all documents matching filter.
+func (c *Collection) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (store.Cursor, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	o := options.MergeFindOptions(opts...)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var docs []bson.D
+	for _, doc := range c.docs {
+		ok, err := match(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, copyDoc(doc))
+		}
+	}
+
+	if o.Sort != nil {
+		keys, err := toDoc(o.Sort)
+		if err != nil {
+			return nil, err
+		}
+		sortDocs(docs, keys)
+	}
+	if o.Skip != nil {
+		if int(*o.Skip) >= len(docs) {
+			docs = nil
+		} else {
+			docs = docs[*o.Skip:]
+		}
+	}
+	if o.Limit != nil && *o.Limit > 0 && int(*o.Limit) < len(docs) {
+		docs = docs[:*o.Limit]
+	}
+	return &cursor{docs: docs}, nil
+}
+
+// sortDocs sorts docs by the given sort specification.
+func sortDocs(docs []bson.D, keys bson.D) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			a, _ := lookup(docs[i], k.Key)
+			b, _ := lookup(docs[j], k.Key)
+			c := compare(a, b)
+			if c == 0 {
+				continue
+			}
+			if dir, _ := number(k.Value); dir < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// FindOne returns the first document matching filter.
+func (c *Collection) FindOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) store.SingleResult {
+
+	fo := options.Find().SetLimit(1)
+	if o := options.MergeFindOneOptions(opts...); o.Sort != nil {
+		fo.SetSort(o.Sort)
+	}
+	cur, err := c.Find(ctx, filter, fo)
+	if err != nil {
+		return &singleResult{err: err}
+	}
+	if !cur.Next(ctx) {
+		return &singleResult{err: mongo.ErrNoDocuments}
+	}
+	return &singleResult{doc: cur.(*cursor).current}
+}
+
+// Drop removes all documents and indexes of the collection.
+func (c *Collection) Drop(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.docs = nil
+	c.indexes = nil
+	c.notify("drop", nil, nil)
+	c.invalidateStreams()
+	return nil
+}
+
+// CreateIndex creates an index described by model. Unique indexes are
+// enforced on every subsequent write.
+func (c *Collection) CreateIndex(ctx context.Context, model mongo.IndexModel) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	keys, err := toDoc(model.Keys)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", errors.New("index keys cannot be empty")
+	}
+	idx := index{keys: keys}
+	if model.Options != nil {
+		if model.Options.Name != nil {
+			idx.name = *model.Options.Name
+		}
+		if model.Options.Unique != nil {
+			idx.unique = *model.Options.Unique
+		}
+	}
+	if idx.name == "" {
+		var parts []string
+		for _, k := range keys {
+			parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+		}
+		idx.name = strings.Join(parts, "_")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, existing := range c.indexes {
+		if existing.name == idx.name {
+			if existing.unique != idx.unique || !equal(existing.keys, idx.keys) {
+				return "", mongo.CommandError{Code: 86, Name: "IndexKeySpecsConflict",
+					Message: "An existing index has the same name as the requested index"}
+			}
+			return idx.name, nil
+		}
+	}
+	if idx.unique {
+		seen := make(map[string]bool)
+		for _, doc := range c.docs {
+			k := indexKey(doc, idx.keys)
+			if seen[k] {
+				return "", mongo.CommandError{Code: duplicateKeyCode, Name: "DuplicateKey",
+					Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s", c.name, idx.name)}
+			}
+			seen[k] = true
+		}
+	}
+	c.indexes = append(c.indexes, idx)
+	return idx.name, nil
+}
+
+// DropIndex drops the index on keys, if any.
+func (c *Collection) DropIndex(ctx context.Context, keys interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	doc, err := toDoc(keys)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, idx := range c.indexes {
+		if equal(idx.keys, doc) {
+			c.indexes = append(c.indexes[:i:i], c.indexes[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// insert adds document to the collection, assigning an ObjectID if it has no
+// _id. The caller must hold the write lock.
+func (c *Collection) insert(document interface{}) (interface{}, error) {
+	doc, err := toDoc(document)
+	if err != nil {
+		return nil, err
+	}
+	doc = copyDoc(doc)
+	id, ok := lookup(doc, "_id")
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	if err := c.checkUnique(doc, -1); err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+	c.notify("insert", id, doc)
+	return id, nil
+}
+
+// checkUnique verifies that doc doesn't violate the _id index or a unique
+// index. The document at position skip is ignored, so that a document can be
+// replaced by an updated version of itself.
+func (c *Collection) checkUnique(doc bson.D, skip int) error {
+	indexes := append([]index{{name: "_id_", keys: bson.D{{Key: "_id", Value: int32(1)}}, unique: true}}, c.indexes...)
+	for _, idx := range indexes {
+		if !idx.unique {
+			continue
+		}
+		key := indexKey(doc, idx.keys)
+		for i, other := range c.docs {
+			if i == skip || indexKey(other, idx.keys) != key {
+				continue
+			}
+			return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+				Code: duplicateKeyCode,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %s",
+					c.name, idx.name, key),
+			}}}
+		}
+	}
+	return nil
+}
+
+// indexKey returns the index entry of doc for the given keys. Missing fields
+// are indexed as null.
+func indexKey(doc bson.D, keys bson.D) string {
+	entry := bson.D{}
+	for _, k := range keys {
+		v, _ := lookup(doc, k.Key)
+		if f, ok := number(v); ok {
+			v = f
+		}
+		entry = append(entry, bson.E{Key: "", Value: v})
+	}
+	return fmt.Sprintf("%#v", entry)
+}
+
+// cursor iterates over a snapshot of matched documents.
+type cursor struct {
+	docs    []bson.D
+	current bson.D
+}
+
+func (c *cursor) Next(ctx context.Context) bool {
+	if len(c.docs) == 0 || ctx.Err() != nil {
+		return false
+	}
+	c.current, c.docs = c.docs[0], c.docs[1:]
+	return true
+}
+
+func (c *cursor) Decode(val interface{}) error {
+	return decode(c.current, val)
+}
+
+func (c *cursor) Err() error {
+	return nil
+}
+
+func (c *cursor) Close(ctx context.Context) error {
+	c.docs = nil
+	return nil
+}
+
+// singleResult is the result of FindOne.
+type singleResult struct {
+	doc bson.D
+	err error
+}
+
+func (r *singleResult) Decode(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return decode(r.doc, v)
+}
+
+func (r *singleResult) Err() error {
+	return r.err
+}
+
+func decode(doc bson.D, val interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, val)
+}
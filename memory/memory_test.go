@@ -0,0 +1,487 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type rule struct {
+	ID    interface{} `bson:"_id,omitempty"`
+	PType string      `bson:"ptype"`
+	V0    string      `bson:"v0"`
+	V1    string      `bson:"v1"`
+}
+
+func newCollection(t *testing.T) store.Collection {
+	t.Helper()
+	c := NewDatabase().Collection("casbin_rule")
+	if _, err := c.CreateIndex(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "ptype", Value: 1}, {Key: "v0", Value: 1}, {Key: "v1", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func find(t *testing.T, c store.Collection, filter interface{}, opts ...*options.FindOptions) []rule {
+	t.Helper()
+	cursor, err := c.Find(context.TODO(), filter, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []rule
+	for cursor.Next(context.TODO()) {
+		var r rule
+		if err := cursor.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func TestCollection_UniqueIndex(t *testing.T) {
+	c := newCollection(t)
+
+	if _, err := c.InsertOne(context.TODO(), rule{PType: "p", V0: "alice", V1: "data1"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.InsertOne(context.TODO(), rule{PType: "p", V0: "alice", V1: "data1"})
+	if _, ok := err.(mongo.WriteException); !ok || !store.IsDuplicateKey(err) {
+		t.Fatalf("expected a duplicate key WriteException; got %v", err)
+	}
+
+	// Ordered inserts stop at the first error, unordered ones continue.
+	docs := []interface{}{
+		rule{PType: "p", V0: "bob", V1: "data2"},
+		rule{PType: "p", V0: "alice", V1: "data1"},
+		rule{PType: "p", V0: "carol", V1: "data3"},
+	}
+	res, err := c.InsertMany(context.TODO(), docs)
+	if _, ok := err.(mongo.BulkWriteException); !ok || !store.IsDuplicateKey(err) {
+		t.Fatalf("expected a duplicate key BulkWriteException; got %v", err)
+	}
+	if len(res.InsertedIDs) != 1 {
+		t.Fatalf("expected 1 insert before the error; got %d", len(res.InsertedIDs))
+	}
+	docs[0] = rule{PType: "p", V0: "dave", V1: "data4"}
+	res, err = c.InsertMany(context.TODO(), docs, options.InsertMany().SetOrdered(false))
+	if !store.IsDuplicateKey(err) || len(res.InsertedIDs) != 2 {
+		t.Fatalf("expected 2 inserts and a duplicate key error; got %v, %v", res.InsertedIDs, err)
+	}
+
+	// Updating a document onto an existing key must fail too.
+	_, err = c.UpdateOne(context.TODO(), bson.M{"v0": "bob"}, bson.M{"$set": bson.M{"v0": "alice", "v1": "data1"}})
+	if !store.IsDuplicateKey(err) {
+		t.Fatalf("expected a duplicate key error; got %v", err)
+	}
+}
+
+func TestCollection_Filters(t *testing.T) {
+	c := newCollection(t)
+	_, err := c.InsertMany(context.TODO(), []interface{}{
+		rule{PType: "p", V0: "alice", V1: "/api/billing/1"},
+		rule{PType: "p", V0: "bob", V1: "/api/users"},
+		rule{PType: "g", V0: "alice", V1: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter interface{}
+		want   int
+	}{
+		{"all", bson.D{}, 3},
+		{"struct", rule{PType: "g", V0: "alice", V1: "admin"}, 1},
+		{"equality", bson.M{"v0": "alice"}, 2},
+		{"empty string does not match missing", bson.M{"v2": ""}, 0},
+		{"null matches missing", bson.M{"v2": nil}, 3},
+		{"in", bson.M{"v0": bson.M{"$in": bson.A{"bob", "carol"}}}, 1},
+		{"in with a Go slice", bson.D{{Key: "v0", Value: bson.D{{Key: "$in", Value: []string{"bob"}}}}}, 1},
+		{"ne", bson.M{"ptype": bson.M{"$ne": "p"}}, 1},
+		{"regex", bson.M{"v1": primitive.Regex{Pattern: "^/api/billing"}}, 1},
+		{"or", bson.M{"$or": bson.A{bson.M{"v0": "bob"}, bson.M{"ptype": "g"}}}, 2},
+		{"exists", bson.M{"v1": bson.M{"$exists": true}}, 3},
+		{"type", bson.M{"_id": bson.M{"$type": "objectId"}}, 3},
+		{"not type", bson.M{"v0": bson.M{"$not": bson.M{"$type": "string"}}}, 0},
+	}
+	for _, tt := range tests {
+		if got := len(find(t, c, tt.filter)); got != tt.want {
+			t.Errorf("%s: expected %d matches; got %d", tt.name, tt.want, got)
+		}
+	}
+
+	if _, err := c.Find(context.TODO(), bson.M{"v0": bson.M{"$bogus": 1}}); err == nil {
+		t.Error("expected an unknown operator to fail")
+	}
+
+	rules := find(t, c, bson.D{}, options.Find().SetSort(bson.D{{Key: "v1", Value: -1}}).SetLimit(2))
+	if len(rules) != 2 || rules[0].V1 != "admin" || rules[1].V1 != "/api/users" {
+		t.Errorf("unexpected sorted page: %v", rules)
+	}
+}
+
+func TestCollection_DeleteAndUpdate(t *testing.T) {
+	c := newCollection(t)
+	_, err := c.InsertMany(context.TODO(), []interface{}{
+		rule{PType: "p", V0: "alice", V1: "data1"},
+		rule{PType: "p", V0: "alice", V1: "data2"},
+		rule{PType: "p", V0: "bob", V1: "data1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.UpdateOne(context.TODO(), bson.M{"v0": "bob"}, bson.M{"$set": bson.M{"v1": "data3"}})
+	if err != nil || res.MatchedCount != 1 || res.ModifiedCount != 1 {
+		t.Fatalf("unexpected update result: %+v, %v", res, err)
+	}
+	if _, err := c.UpdateOne(context.TODO(), bson.M{"v0": "bob"}, bson.M{"v1": "data3"}); err == nil {
+		t.Error("expected a replacement document to be rejected")
+	}
+
+	var r rule
+	if err := c.FindOne(context.TODO(), bson.M{"v0": "bob"}).Decode(&r); err != nil || r.V1 != "data3" {
+		t.Fatalf("expected updated rule; got %+v, %v", r, err)
+	}
+	if err := c.FindOne(context.TODO(), bson.M{"v0": "carol"}).Err(); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected ErrNoDocuments; got %v", err)
+	}
+
+	if err := c.FindOneAndUpdate(context.TODO(), bson.M{"v0": "bob"}, bson.M{"$set": bson.M{"v1": "data4"}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&r); err != nil || r.V1 != "data4" {
+		t.Fatalf("expected the updated rule to be returned; got %+v, %v", r, err)
+	}
+	if err := c.FindOneAndUpdate(context.TODO(), bson.M{"v0": "carol"}, bson.M{"$set": bson.M{"v1": "data4"}}).Err(); err != mongo.ErrNoDocuments {
+		t.Fatalf("expected ErrNoDocuments; got %v", err)
+	}
+
+	del, err := c.DeleteOne(context.TODO(), bson.M{"v0": "alice"})
+	if err != nil || del.DeletedCount != 1 {
+		t.Fatalf("unexpected delete result: %+v, %v", del, err)
+	}
+	del, err = c.DeleteMany(context.TODO(), bson.M{"ptype": "p"})
+	if err != nil || del.DeletedCount != 2 {
+		t.Fatalf("unexpected delete result: %+v, %v", del, err)
+	}
+
+	if err := c.Drop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.InsertMany(context.TODO(), []interface{}{rule{PType: "p"}, rule{PType: "p"}}); err != nil {
+		t.Errorf("expected indexes to be dropped with the collection; got %v", err)
+	}
+}
+
+func TestCollection_UpdatePaths(t *testing.T) {
+	c := newCollection(t)
+	res, err := c.InsertOne(context.TODO(), bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bson.M{"_id": res.InsertedID}
+
+	// Dotted keys reach into embedded documents, creating them as needed.
+	if _, err := c.UpdateOne(context.TODO(), id, bson.M{"$set": bson.M{"meta.by": "bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdateOne(context.TODO(), id, bson.M{"$inc": bson.M{"meta.version": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Meta struct {
+			By      string `bson:"by"`
+			Version int32  `bson:"version"`
+		} `bson:"meta"`
+	}
+	if err := c.FindOne(context.TODO(), bson.M{"meta.by": "bob"}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Meta.Version != 1 {
+		t.Errorf("expected the embedded version to be incremented; got %+v", doc)
+	}
+	if _, err := c.UpdateOne(context.TODO(), id, bson.M{"$unset": bson.M{"meta.by": ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FindOne(context.TODO(), bson.M{"meta.by": bson.M{"$exists": true}}).Err(); err != mongo.ErrNoDocuments {
+		t.Errorf("expected the embedded field to be unset; got %v", err)
+	}
+
+	_, err = c.UpdateOne(context.TODO(), id, bson.M{"$set": bson.M{"v0.name": "bob"}})
+	if we, ok := err.(mongo.WriteException); !ok || len(we.WriteErrors) != 1 || we.WriteErrors[0].Code != 28 {
+		t.Errorf("expected a field inside a string to be rejected; got %v", err)
+	}
+
+	// The _id of a document may be set to its value, but not changed.
+	if _, err := c.UpdateOne(context.TODO(), id, bson.M{"$set": bson.M{"_id": res.InsertedID}}); err != nil {
+		t.Errorf("expected setting the same _id to succeed; got %v", err)
+	}
+	_, err = c.UpdateOne(context.TODO(), id, bson.M{"$set": bson.M{"_id": "other"}})
+	if we, ok := err.(mongo.WriteException); !ok || len(we.WriteErrors) != 1 || we.WriteErrors[0].Code != 66 {
+		t.Errorf("expected an ImmutableField error; got %v", err)
+	}
+	if err := c.FindOne(context.TODO(), id).Err(); err != nil {
+		t.Errorf("expected the document to keep its _id; got %v", err)
+	}
+}
+
+func TestCollection_Watch(t *testing.T) {
+	c := newCollection(t)
+	stream, err := c.Watch(context.TODO(), mongo.Pipeline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.InsertOne(context.TODO(), rule{PType: "p", V0: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteMany(context.TODO(), bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Drop(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	for stream.Next(context.TODO()) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, event.OperationType)
+	}
+	if expected := []string{"insert", "delete", "drop", "invalidate"}; fmt.Sprint(ops) != fmt.Sprint(expected) {
+		t.Errorf("Events: %v, supposed to be %v", ops, expected)
+	}
+
+	// Next blocks until the context is done when there are no events.
+	stream, err = c.Watch(context.TODO(), mongo.Pipeline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if stream.Next(ctx) || stream.Err() != context.DeadlineExceeded {
+		t.Errorf("Expected Next to time out; got %v", stream.Err())
+	}
+}
+
+func TestCollection_Aggregate(t *testing.T) {
+	c := newCollection(t)
+	_, err := c.InsertMany(context.TODO(), []interface{}{
+		rule{PType: "p", V0: "alice", V1: "data1"},
+		rule{PType: "p", V0: "alice", V1: "data2"},
+		rule{PType: "p", V0: "bob", V1: "data1"},
+		rule{PType: "g", V0: "alice", V1: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cursor, err := c.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"ptype": "p"}}},
+		{{Key: "$facet", Value: bson.D{
+			{Key: "total", Value: bson.A{bson.M{"$count": "n"}}},
+			{Key: "subjects", Value: bson.A{
+				bson.M{"$group": bson.D{
+					{Key: "_id", Value: "$v0"},
+					{Key: "count", Value: bson.M{"$sum": 1}},
+					{Key: "objects", Value: bson.M{"$addToSet": "$v1"}},
+				}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": 1},
+			}},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type facets struct {
+		Total []struct {
+			N int `bson:"n"`
+		} `bson:"total"`
+		Subjects []struct {
+			ID      string   `bson:"_id"`
+			Count   int      `bson:"count"`
+			Objects []string `bson:"objects"`
+		} `bson:"subjects"`
+	}
+	var results []facets
+	for cursor.Next(context.TODO()) {
+		var r facets
+		if err := cursor.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, r)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected a single facet result; got %d", len(results))
+	}
+	r := results[0]
+	if len(r.Total) != 1 || r.Total[0].N != 3 {
+		t.Errorf("Total: %+v, supposed to be 3", r.Total)
+	}
+	if len(r.Subjects) != 1 || r.Subjects[0].ID != "alice" || r.Subjects[0].Count != 2 ||
+		fmt.Sprint(r.Subjects[0].Objects) != "[data1 data2]" {
+		t.Errorf("Subjects: %+v, supposed to be alice with 2 rules", r.Subjects)
+	}
+
+	// $switch picks the field to group by from the ptype.
+	cursor, err = c.Aggregate(context.TODO(), mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.M{"$switch": bson.D{
+				{Key: "branches", Value: bson.A{bson.D{
+					{Key: "case", Value: bson.M{"$eq": bson.A{"$ptype", "g"}}},
+					{Key: "then", Value: "$v1"},
+				}}},
+				{Key: "default", Value: "$v0"},
+			}}},
+		}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for cursor.Next(context.TODO()) {
+		var g struct {
+			ID string `bson:"_id"`
+		}
+		if err := cursor.Decode(&g); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, g.ID)
+	}
+	if fmt.Sprint(ids) != "[admin alice bob]" {
+		t.Errorf("Groups: %v, supposed to be [admin alice bob]", ids)
+	}
+
+	if _, err := c.Aggregate(context.TODO(), mongo.Pipeline{{{Key: "$out", Value: "other"}}}); err == nil {
+		t.Error("expected an unsupported stage to be rejected")
+	}
+}
+
+func TestDatabase_WithTransaction(t *testing.T) {
+	db := NewDatabase()
+	c := db.Collection("casbin_rule")
+	if _, err := c.InsertOne(context.TODO(), rule{PType: "p", V0: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := fmt.Errorf("failed")
+	err := db.WithTransaction(context.TODO(), func(ctx context.Context) error {
+		if _, err := c.DeleteMany(ctx, bson.D{}); err != nil {
+			return err
+		}
+		if _, err := db.Collection("other").InsertOne(ctx, rule{PType: "g"}); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("Expected the error of the transaction; got %v", err)
+	}
+	if rules := find(t, c, bson.D{}); len(rules) != 1 || rules[0].V0 != "alice" {
+		t.Errorf("Expected the deleted rule to be restored; got %v", rules)
+	}
+	if rules := find(t, db.Collection("other"), bson.D{}); len(rules) != 0 {
+		t.Errorf("Expected the inserted rule to be rolled back; got %v", rules)
+	}
+
+	err = db.WithTransaction(context.TODO(), func(ctx context.Context) error {
+		_, err := c.DeleteMany(ctx, bson.D{})
+		return err
+	})
+	if rules := find(t, c, bson.D{}); err != nil || len(rules) != 0 {
+		t.Errorf("Expected the rule to be deleted; got %v, %v", rules, err)
+	}
+}
+
+func TestCollection_GraphLookup(t *testing.T) {
+	c := newCollection(t)
+	_, err := c.InsertMany(context.TODO(), []interface{}{
+		rule{PType: "g", V0: "alice", V1: "editor"},
+		rule{PType: "g", V0: "editor", V1: "viewer"},
+		rule{PType: "g", V0: "viewer", V1: "guest"},
+		rule{PType: "g", V0: "guest", V1: "editor"},
+		rule{PType: "g2", V0: "editor", V1: "other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(maxDepth interface{}) map[string]int64 {
+		t.Helper()
+		spec := bson.D{
+			{Key: "from", Value: "casbin_rule"},
+			{Key: "startWith", Value: "$v1"},
+			{Key: "connectFromField", Value: "v1"},
+			{Key: "connectToField", Value: "v0"},
+			{Key: "as", Value: "links"},
+			{Key: "depthField", Value: "depth"},
+			{Key: "restrictSearchWithMatch", Value: bson.M{"ptype": "g"}},
+		}
+		if maxDepth != nil {
+			spec = append(spec, bson.E{Key: "maxDepth", Value: maxDepth})
+		}
+		cursor, err := c.Aggregate(context.TODO(), mongo.Pipeline{
+			{{Key: "$match", Value: bson.M{"v0": "alice"}}},
+			{{Key: "$graphLookup", Value: spec}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Links []struct {
+				V1    string `bson:"v1"`
+				Depth int64  `bson:"depth"`
+			} `bson:"links"`
+		}
+		if !cursor.Next(context.TODO()) {
+			t.Fatal("Expected a document")
+		}
+		if err := cursor.Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		depths := make(map[string]int64)
+		for _, l := range out.Links {
+			depths[l.V1] = l.Depth
+		}
+		return depths
+	}
+
+	// The cycle back to editor is followed once, and g2 links are ignored.
+	if depths := lookup(nil); fmt.Sprint(depths) != "map[editor:2 guest:1 viewer:0]" {
+		t.Errorf("Links: %v, supposed to reach viewer, guest and editor", depths)
+	}
+	if depths := lookup(0); fmt.Sprint(depths) != "map[viewer:0]" {
+		t.Errorf("Links: %v, supposed to stop at depth 0", depths)
+	}
+}
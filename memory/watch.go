@@ -0,0 +1,166 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watch opens a change stream on the collection. Events are shaped like the
+// server's: operationType, documentKey, ns, and fullDocument for inserts.
+// Aggregation pipelines are not supported.
+func (c *Collection) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (store.ChangeStream, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if pipeline != nil && reflect.ValueOf(pipeline).Kind() == reflect.Slice && reflect.ValueOf(pipeline).Len() > 0 {
+		return nil, errors.New("change stream pipelines are not supported by the memory backend")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := &changeStream{coll: c, signal: make(chan struct{}, 1)}
+	if c.streams == nil {
+		c.streams = make(map[*changeStream]struct{})
+	}
+	c.streams[s] = struct{}{}
+	return s, nil
+}
+
+// notify publishes a change event to the open change streams. The caller must
+// hold the write lock.
+func (c *Collection) notify(operationType string, id interface{}, doc bson.D) {
+	if len(c.streams) == 0 {
+		return
+	}
+	c.seq++
+	event := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: c.seq}}},
+		{Key: "operationType", Value: operationType},
+		{Key: "ns", Value: bson.D{{Key: "coll", Value: c.name}}},
+	}
+	if id != nil {
+		event = append(event, bson.E{Key: "documentKey", Value: bson.D{{Key: "_id", Value: id}}})
+	}
+	if doc != nil {
+		event = append(event, bson.E{Key: "fullDocument", Value: copyDoc(doc)})
+	}
+	for s := range c.streams {
+		s.push(event)
+	}
+}
+
+// invalidateStreams ends the open change streams with an invalidate event,
+// like the server does when a collection is dropped. The caller must hold the
+// write lock.
+func (c *Collection) invalidateStreams() {
+	c.notify("invalidate", nil, nil)
+	for s := range c.streams {
+		s.mu.Lock()
+		s.invalidated = true
+		s.mu.Unlock()
+	}
+	c.streams = nil
+}
+
+// changeStream is an open change stream on a collection.
+type changeStream struct {
+	coll    *Collection
+	mu      sync.Mutex
+	events  []bson.D
+	current bson.D
+	signal  chan struct{}
+	closed  bool
+	err     error
+
+	// invalidated is set once the last event has been queued.
+	invalidated bool
+}
+
+func (s *changeStream) push(event bson.D) {
+	s.mu.Lock()
+	s.events = append(s.events, event)
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *changeStream) Next(ctx context.Context) bool {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return false
+		}
+		if len(s.events) > 0 {
+			s.current, s.events = s.events[0], s.events[1:]
+			s.mu.Unlock()
+			return true
+		}
+		if s.invalidated {
+			s.mu.Unlock()
+			return false
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.signal:
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.err = ctx.Err()
+			s.mu.Unlock()
+			return false
+		}
+	}
+}
+
+func (s *changeStream) Decode(val interface{}) error {
+	return decode(s.current, val)
+}
+
+func (s *changeStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *changeStream) Close(ctx context.Context) error {
+	s.coll.mu.Lock()
+	delete(s.coll.streams, s)
+	s.coll.mu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+// Option configures optional adapter behaviour. Options are passed to the
+// constructors after the optional timeout, e.g.
+//
+//	a, err := NewAdapter(url, 10*time.Second, WithDiffSave())
+type Option func(*adapter) error
+
+// WithDiffSave makes SavePolicy write only the difference between the model
+// and the stored policy instead of rewriting the whole collection. See
+// DiffAdapter.SavePolicyDiff.
+func WithDiffSave() Option {
+	return func(a *adapter) error {
+		a.diffSave = true
+		return nil
+	}
+}
+
+// WithValidation makes the adapter check every rule it writes against m. Rules
+// whose ptype is not defined in m, or whose number of values doesn't match the
+// definition, are rejected with an error wrapping ErrInvalidRule.
+func WithValidation(m model.Model) Option {
+	return func(a *adapter) error {
+		a.validation = m
+		return nil
+	}
+}
+
+// WithEncryption encrypts the values at the given positions (0 for v0 through
+// 5 for v5) with a deterministic AEAD keyed by key, which must be 16, 24 or 32
+// bytes long. Equal values encrypt to the same ciphertext, so equality
+// filters, RemoveFilteredPolicy and the unique index keep working. Filters
+// passed to LoadFilteredPolicy may only use equality, $eq, $ne, $in and $nin
+// on encrypted fields.
+func WithEncryption(key []byte, positions ...int) Option {
+	return func(a *adapter) error {
+		c, err := newFieldCipher(key, positions)
+		if err != nil {
+			return err
+		}
+		a.cipher = c
+		return nil
+	}
+}
+
+// WithCache serves LoadPolicy and LoadFilteredPolicy from c when the same
+// filter was loaded before. The cache is cleared by a change stream on the
+// rule collection, which requires a replica set or sharded cluster.
+func WithCache(c *PolicyCache) Option {
+	return func(a *adapter) error {
+		a.cache = c
+		return nil
+	}
+}
+
+// WithStatsTop sets the number of subjects and roles ranked by Stats. The
+// default is 10.
+func WithStatsTop(n int) Option {
+	return func(a *adapter) error {
+		if n <= 0 {
+			return errors.New("the number of ranked values must be positive")
+		}
+		a.statsTop = n
+		return nil
+	}
+}
+
+// WithStatsValues sets the number of most frequent values counted by Stats at
+// each position of the rules. The default is 100.
+func WithStatsValues(n int) Option {
+	return func(a *adapter) error {
+		if n <= 0 {
+			return errors.New("the number of counted values must be positive")
+		}
+		a.statsValues = n
+		return nil
+	}
+}
+
+// WithLock takes a lease-based lock, stored in a MongoDB collection, around
+// SavePolicy and the other operations writing many rules, so that concurrent
+// saves from several processes don't interleave.
+func WithLock(opts LockOptions) Option {
+	return func(a *adapter) error {
+		l, err := newLocker(opts)
+		if err != nil {
+			return err
+		}
+		a.locker = l
+		return nil
+	}
+}
+
+// WithCollections stores the rules of some sections or ptypes in their own
+// collections, with their own indexes. Keys are sections ("p", "g") or ptypes
+// ("p2", "g2"); a ptype key takes precedence over the key of its section.
+// Rules matching no key are stored in casbin_rule, which is configured by the
+// empty key. Loads, saves, removes and updates are routed to the right
+// collection.
+func WithCollections(layout map[string]CollectionSpec) Option {
+	return func(a *adapter) error {
+		for key, spec := range layout {
+			if key != "" && spec.Name == "" {
+				return fmt.Errorf("no collection name for %q", key)
+			}
+		}
+		a.layout = layout
+		return nil
+	}
+}
+
+// WithBackupCompression makes Backup compress the archive with gzip at the
+// given level, e.g. gzip.BestCompression. Restore detects compressed archives
+// by themselves.
+func WithBackupCompression(level int) Option {
+	return func(a *adapter) error {
+		if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+			return err
+		}
+		a.backupGzip = true
+		a.backupLevel = level
+		return nil
+	}
+}
+
+// WithNonTransactionalRestore lets Restore replace the policy on standalone
+// servers, which don't support transactions. A restore failing there can
+// leave the policy empty or partly restored.
+func WithNonTransactionalRestore() Option {
+	return func(a *adapter) error {
+		a.nonTxRestore = true
+		return nil
+	}
+}
+
+// WithSkipDuplicates makes SavePolicy and Restore insert the rules unordered
+// and skip those already stored, instead of stopping at the first duplicate
+// and leaving the policy half-written. The skipped rules are passed to report,
+// which may be nil, once the save or restore has succeeded.
+func WithSkipDuplicates(report func(skipped []CasbinRule)) Option {
+	return func(a *adapter) error {
+		a.skipDups = true
+		a.onSkipped = report
+		return nil
+	}
+}
+
+// WithFieldNames stores the ptype and values of the rules under the given
+// field names, e.g. to use existing collections whose documents look like
+// {type: "p", subject: "alice", object: "data1", action: "read"}. The names
+// are translated in the documents, filters, updates and indexes, so filters
+// passed to the adapter may use the default or the configured names.
+func WithFieldNames(names FieldNames) Option {
+	return func(a *adapter) error {
+		stored, err := names.storedNames()
+		if err != nil {
+			return err
+		}
+		a.fields = stored
+		return nil
+	}
+}
+
+// WithNamedFields stores the values of the rules of each p ptype of m under
+// the names of its definition, so that "p = sub, obj, act" gives documents
+// like {ptype: "p", sub: "alice", obj: "data1", act: "read"}. Filters may use
+// these names or v0 to v5. The unique index on the rules covers the named
+// fields; the former unique index of an existing collection is dropped.
+func WithNamedFields(m model.Model) Option {
+	return func(a *adapter) error {
+		named, err := modelFieldNames(m)
+		if err != nil {
+			return err
+		}
+		a.named = named
+		return nil
+	}
+}
+
+// WithRuleIDs derives the document ID of the rules from their section, ptype
+// and values, so that adding a stored rule is a no-op and other systems can
+// refer to a rule by a stable ID. See RuleIDAdapter. Updating a rule replaces
+// its document with one holding the ID of the new values. Rules stored before
+// keep their IDs until they are saved again or MigrateRuleIDs is run, and may
+// be skipped by the following pages of FindPolicies until then.
+func WithRuleIDs() Option {
+	return func(a *adapter) error {
+		a.ruleIDs = true
+		return nil
+	}
+}
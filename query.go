@@ -0,0 +1,262 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultPageSize is the number of rules returned by FindPolicies when the
+// page size is not set.
+const defaultPageSize = 100
+
+// ErrInvalidCursor is returned by FindPolicies for a malformed page cursor.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// ValueMatch matches the value at one position of a rule.
+type ValueMatch struct {
+	// Value is the value, or value prefix, to match.
+	Value string
+	// Prefix matches the values starting with Value instead of equal to it.
+	Prefix bool
+}
+
+// PolicyQuery selects and orders stored rules.
+type PolicyQuery struct {
+	// Sec and PType, when set, select the rules of a section and a ptype.
+	Sec   string
+	PType string
+	// Values matches the values of a rule by position: Values[0] matches v0.
+	// Positions left nil match any value.
+	Values [6]*ValueMatch
+	// SortBy is the field the rules are sorted by: "ptype" or "v0" through
+	// "v5". Rules are returned in storage order when it is empty. With
+	// WithNamedFields, sorting by a value requires PType, which tells the
+	// stored name of the value.
+	SortBy string
+	// Descending reverses the sort order.
+	Descending bool
+}
+
+// Page selects a page of results.
+type Page struct {
+	// Size is the maximum number of rules returned. The default is 100.
+	Size int
+	// Cursor is the Next cursor of the previous page, or empty for the first
+	// page.
+	Cursor string
+}
+
+// PolicyPage is a page of rules returned by FindPolicies.
+type PolicyPage struct {
+	Rules []CasbinRule
+	// Next is the cursor of the following page, or empty if this page is the
+	// last one.
+	Next string
+}
+
+// QueryAdapter is the interface for adapters that can search the stored
+// policy without loading it.
+type QueryAdapter interface {
+	persist.Adapter
+	// FindPolicies returns a page of the stored rules matching query.
+	FindPolicies(ctx context.Context, query PolicyQuery, page Page) (PolicyPage, error)
+}
+
+// pageCursor is the position after the last rule of a page: the value of the
+// sort field and the document ID.
+type pageCursor struct {
+	Value interface{} `bson:"v"`
+	ID    interface{} `bson:"id"`
+}
+
+// FindPolicies returns a page of the stored rules matching query. Pages are
+// read with a range query on the sort field and the document ID, so every page
+// costs the same regardless of its position and rules added or removed
+// between two calls don't shift the following pages.
+func (a *adapter) FindPolicies(ctx context.Context, query PolicyQuery, page Page) (PolicyPage, error) {
+	var result PolicyPage
+
+	switch query.SortBy {
+	case "", "ptype", "v0", "v1", "v2", "v3", "v4", "v5":
+	default:
+		return result, fmt.Errorf("cannot sort by %q", query.SortBy)
+	}
+	if a.cipher != nil && a.cipher.fields[query.SortBy] {
+		return result, fmt.Errorf("cannot sort by encrypted field %s", query.SortBy)
+	}
+	if len(a.named) > 0 && query.PType == "" && strings.HasPrefix(query.SortBy, "v") {
+		return result, fmt.Errorf("cannot sort by %s with named fields, the query must select a ptype", query.SortBy)
+	}
+	size := page.Size
+	if size <= 0 {
+		size = defaultPageSize
+	}
+
+	filter, err := a.queryFilter(query)
+	if err != nil {
+		return result, err
+	}
+	if page.Cursor != "" {
+		after, err := a.afterCursor(query, page.Cursor)
+		if err != nil {
+			return result, err
+		}
+		filter = append(filter, after)
+	}
+
+	dir := 1
+	if query.Descending {
+		dir = -1
+	}
+	sort := bson.D{{Key: "_id", Value: dir}}
+	if query.SortBy != "" {
+		sort = append(bson.D{{Key: query.SortBy, Value: dir}}, sort...)
+	}
+
+	var coll store.Collection
+	if query.PType != "" {
+		coll = a.collectionFor(query.Sec, query.PType)
+	} else if colls := a.sectionCollections(query.Sec); len(colls) == 1 {
+		coll = colls[0]
+	} else {
+		return result, errors.New("the query spans several collections, it must select a ptype")
+	}
+
+	// One more rule than requested tells whether there is a next page.
+	cursor, err := coll.Find(ctx, bson.D{{Key: "$and", Value: filter}},
+		options.Find().SetSort(sort).SetLimit(int64(size+1)))
+	if err != nil {
+		return result, err
+	}
+	defer cursor.Close(ctx)
+
+	var last CasbinRule
+	for cursor.Next(ctx) {
+		if len(result.Rules) == size {
+			next, err := encodeCursor(query.SortBy, last)
+			if err != nil {
+				return result, err
+			}
+			result.Next = next
+			break
+		}
+		var stored CasbinRule
+		if err := cursor.Decode(&stored); err != nil {
+			return result, err
+		}
+		last = stored
+		line, err := a.cipher.decryptLine(stored)
+		if err != nil {
+			return result, err
+		}
+		result.Rules = append(result.Rules, line)
+	}
+	return result, cursor.Err()
+}
+
+// queryFilter returns the clauses selecting the rules matching query.
+func (a *adapter) queryFilter(query PolicyQuery) (bson.A, error) {
+	filter := bson.A{bson.D{}}
+	if query.Sec != "" {
+		if query.PType != "" {
+			filter = append(filter, bson.D{{Key: "sec", Value: sectionSelector(query.Sec, query.PType)}})
+		} else {
+			filter = append(filter, sectionFilter(query.Sec))
+		}
+	}
+	if query.PType != "" {
+		filter = append(filter, bson.D{{Key: "ptype", Value: query.PType}})
+	}
+	for i, m := range query.Values {
+		if m == nil {
+			continue
+		}
+		field := fmt.Sprintf("v%d", i)
+		if !m.Prefix {
+			filter = append(filter, bson.D{{Key: field, Value: a.cipher.encrypt(field, m.Value)}})
+			continue
+		}
+		if a.cipher != nil && a.cipher.fields[field] {
+			return nil, fmt.Errorf("cannot match a prefix of encrypted field %s", field)
+		}
+		filter = append(filter, bson.D{{Key: field, Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(m.Value)}}})
+	}
+	return filter, nil
+}
+
+// afterCursor returns the clause selecting the rules sorted after the cursor.
+func (a *adapter) afterCursor(query PolicyQuery, token string) (bson.D, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c pageCursor
+	if err := bson.Unmarshal(raw, &c); err != nil || c.ID == nil {
+		return nil, ErrInvalidCursor
+	}
+
+	op := "$gt"
+	if query.Descending {
+		op = "$lt"
+	}
+	if query.SortBy == "" {
+		return bson.D{{Key: "_id", Value: bson.D{{Key: op, Value: c.ID}}}}, nil
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: query.SortBy, Value: bson.D{{Key: op, Value: c.Value}}}},
+		bson.D{
+			{Key: query.SortBy, Value: c.Value},
+			{Key: "_id", Value: bson.D{{Key: op, Value: c.ID}}},
+		},
+	}}}, nil
+}
+
+// encodeCursor returns the cursor of the page following the stored line.
+func encodeCursor(sortBy string, line CasbinRule) (string, error) {
+	c := pageCursor{ID: line.ID}
+	switch sortBy {
+	case "ptype":
+		c.Value = line.PType
+	case "v0":
+		c.Value = line.V0
+	case "v1":
+		c.Value = line.V1
+	case "v2":
+		c.Value = line.V2
+	case "v3":
+		c.Value = line.V3
+	case "v4":
+		c.Value = line.V4
+	case "v5":
+		c.Value = line.V5
+	}
+	raw, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+)
+
+func TestAdapter_FindPolicies(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(a.(*adapter), []interface{}{
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "/api/billing/invoices", V2: "GET"},
+		CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "/api/billing/payments", V2: "POST"},
+		CasbinRule{Sec: "p", PType: "p", V0: "carol", V1: "/api/billing", V2: "GET"},
+		CasbinRule{Sec: "p", PType: "p", V0: "dave", V1: "/api/users", V2: "GET"},
+		CasbinRule{Sec: "p", PType: "p", V0: "erin", V1: "/api/billing.v2", V2: "GET"},
+		CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "/api/billing"},
+	})
+	qa := a.(QueryAdapter)
+
+	query := PolicyQuery{
+		Sec:        "p",
+		Values:     [6]*ValueMatch{1: {Value: "/api/billing/", Prefix: true}},
+		SortBy:     "v0",
+		Descending: true,
+	}
+	res, err := qa.FindPolicies(context.TODO(), query, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subjects(res.Rules) != "bob alice" || res.Next != "" {
+		t.Errorf("Rules: %v, supposed to be bob and alice", res.Rules)
+	}
+
+	// Page through the policy rules, two at a time.
+	query = PolicyQuery{PType: "p", SortBy: "v2"}
+	var pages []string
+	page := Page{Size: 2}
+	for {
+		res, err := qa.FindPolicies(context.TODO(), query, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, subjects(res.Rules))
+		if res.Next == "" {
+			break
+		}
+		page.Cursor = res.Next
+	}
+	if expected := "alice carol | dave erin | bob"; strings.Join(pages, " | ") != expected {
+		t.Errorf("Pages: %q, supposed to be %s", pages, expected)
+	}
+
+	res, err = qa.FindPolicies(context.TODO(), PolicyQuery{Values: [6]*ValueMatch{1: {Value: "/api/billing"}}}, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Rules) != 2 || res.Rules[0].Sec != "p" || res.Rules[1].Sec != "g" {
+		t.Errorf("Rules: %v, supposed to match /api/billing exactly", res.Rules)
+	}
+
+	if _, err := qa.FindPolicies(context.TODO(), PolicyQuery{}, Page{Cursor: "bogus"}); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor; got %v", err)
+	}
+	if _, err := qa.FindPolicies(context.TODO(), PolicyQuery{SortBy: "_id"}, Page{}); err == nil {
+		t.Error("Expected sorting by an unknown field to be rejected")
+	}
+}
+
+func subjects(rules []CasbinRule) string {
+	var s string
+	for i, r := range rules {
+		if i > 0 {
+			s += " "
+		}
+		s += r.V0
+	}
+	return s
+}
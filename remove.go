@@ -0,0 +1,102 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RemovedRulesAdapter is the interface for adapters telling which rules a
+// filtered removal deleted.
+type RemovedRulesAdapter interface {
+	persist.Adapter
+	// RemoveFilteredRules removes the rules matched as by
+	// RemoveFilteredPolicy and returns them. It returns an empty slice and a
+	// nil error if no rule matched.
+	RemoveFilteredRules(ctx context.Context, sec string, ptype string, fieldIndex int,
+		fieldValues ...string) ([][]string, error)
+}
+
+// RemoveFilteredRules removes the rules matching the filter and returns
+// them. Each matching rule is deleted by its ID and version, so that the
+// rules removed or updated by another process meanwhile aren't reported on
+// servers without transactions.
+func (a *adapter) RemoveFilteredRules(ctx context.Context, sec string, ptype string, fieldIndex int,
+	fieldValues ...string) ([][]string, error) {
+
+	filter, err := a.fieldFilter(sec, ptype, fieldIndex, fieldValues)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, unlock, err := a.locker.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	defer a.cache.Invalidate()
+
+	coll := a.collectionFor(sec, ptype)
+	var removed [][]string
+	err = a.database.WithTransaction(ctx, func(ctx context.Context) error {
+		// The transaction may be retried.
+		removed = [][]string{}
+		cursor, err := coll.Find(ctx, filter)
+		if err != nil {
+			return err
+		}
+		var lines []CasbinRule
+		for cursor.Next(ctx) {
+			var line CasbinRule
+			if err := cursor.Decode(&line); err != nil {
+				cursor.Close(ctx)
+				return err
+			}
+			lines = append(lines, line)
+		}
+		if err := cursor.Err(); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		if err := cursor.Close(ctx); err != nil {
+			return err
+		}
+
+		for _, line := range lines {
+			rule, err := a.cipher.decryptLine(line)
+			if err != nil {
+				return err
+			}
+			res, err := coll.DeleteOne(ctx, bson.D{
+				{Key: "_id", Value: line.ID},
+				{Key: "version", Value: versionSelector(line.Version)},
+			})
+			if err != nil {
+				return err
+			}
+			if res.DeletedCount > 0 {
+				removed = append(removed, ruleValues(rule))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/util"
+)
+
+func TestAdapter_RemoveFilteredRules(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithEncryption(testKey, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatal(err)
+	}
+	ra := a.(RemovedRulesAdapter)
+
+	removed, err := ra.RemoveFilteredRules(context.TODO(), "p", "p", 1, "data2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("Removed: ", removed)
+	want := [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	if !util.Array2DEquals(want, removed) {
+		t.Error("Removed: ", removed, ", supposed to be ", want)
+	}
+
+	e, err = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+
+	// No match is told apart from a failure.
+	removed, err = ra.RemoveFilteredRules(context.TODO(), "p", "p", 1, "data2")
+	if err != nil || removed == nil || len(removed) != 0 {
+		t.Errorf("Removed: %v, %v, supposed to be an empty slice and no error", removed, err)
+	}
+}
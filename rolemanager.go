@@ -0,0 +1,332 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/casbin/casbin/v2/log"
+	"github.com/casbin/casbin/v2/persist"
+	"github.com/casbin/casbin/v2/rbac"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxHierarchyLevel is the maximum number of links followed by HasLink, as
+// in the default role manager of casbin.
+const maxHierarchyLevel = 10
+
+// RoleManager is an rbac.RoleManager resolving the links of a grouping ptype
+// from the rules stored by an adapter, so that an enforcer doesn't need to
+// hold them in memory. The direct roles and users of a name are cached in a
+// bounded LRU cache.
+//
+// The stored rules are the source of truth: AddLink and DeleteLink don't
+// write anything, they only drop the cached links of the names they're given,
+// as the enforcer has already saved the rule. Changes made by other processes
+// are seen once the cache is cleared, e.g. by loading the policy again.
+type RoleManager struct {
+	a          *adapter
+	ptype      string
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	gen     uint64
+	logger  log.Logger
+}
+
+// roleEntry holds the direct links of a name.
+type roleEntry struct {
+	key   string
+	names []string
+}
+
+var _ rbac.RoleManager = (*RoleManager)(nil)
+
+// NewRoleManager creates a role manager for the grouping ptype, "g" if
+// empty, of an adapter of this package. It caches the links of at most
+// maxEntries names, or of any number if maxEntries is 0.
+//
+// To keep only the p rules in memory, the enforcer should load its policy with
+// a filter excluding the grouping rules, e.g.
+//
+//	e.SetRoleManager(rm)
+//	e.LoadFilteredPolicy(bson.M{"ptype": bson.M{"$regex": "^p"}})
+func NewRoleManager(a persist.Adapter, ptype string, maxEntries int) (*RoleManager, error) {
+	ma, ok := a.(*adapter)
+	if !ok {
+		return nil, errors.New("the role manager needs an adapter of this package")
+	}
+	if maxEntries < 0 {
+		return nil, errors.New("the maximum number of entries must not be negative")
+	}
+	if ptype == "" {
+		ptype = "g"
+	}
+	return &RoleManager{
+		a:          ma,
+		ptype:      ptype,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		logger:     &log.DefaultLogger{},
+	}, nil
+}
+
+// roleDomain returns the domain of a role manager call.
+func roleDomain(domain []string) (string, error) {
+	switch len(domain) {
+	case 0:
+		return "", nil
+	case 1:
+		return domain[0], nil
+	}
+	return "", errors.New("error: domain should be 1 parameter")
+}
+
+// Clear drops the cached links.
+func (rm *RoleManager) Clear() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	rm.gen++
+	rm.entries = make(map[string]*list.Element)
+	rm.lru.Init()
+	return nil
+}
+
+// AddLink drops the cached links of name1 and name2, as the rule linking them
+// was added.
+func (rm *RoleManager) AddLink(name1 string, name2 string, domain ...string) error {
+	return rm.linkChanged(name1, name2, domain)
+}
+
+// DeleteLink drops the cached links of name1 and name2, as the rule linking
+// them was removed.
+func (rm *RoleManager) DeleteLink(name1 string, name2 string, domain ...string) error {
+	return rm.linkChanged(name1, name2, domain)
+}
+
+func (rm *RoleManager) linkChanged(name1 string, name2 string, domain []string) error {
+	d, err := roleDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	rm.gen++
+	for _, key := range []string{roleKey(true, name1, d), roleKey(false, name2, d)} {
+		if e, ok := rm.entries[key]; ok {
+			rm.remove(e)
+		}
+	}
+	return nil
+}
+
+// HasLink reports whether name1 inherits name2, directly or through at most
+// ten links.
+func (rm *RoleManager) HasLink(name1 string, name2 string, domain ...string) (bool, error) {
+	d, err := roleDomain(domain)
+	if err != nil {
+		return false, err
+	}
+	if name1 == name2 {
+		return true, nil
+	}
+
+	seen := map[string]bool{name1: true}
+	frontier := []string{name1}
+	for level := 0; level < maxHierarchyLevel && len(frontier) > 0; level++ {
+		var next []string
+		for _, name := range frontier {
+			roles, err := rm.links(true, name, d)
+			if err != nil {
+				return false, err
+			}
+			for _, role := range roles {
+				if role == name2 {
+					return true, nil
+				}
+				if !seen[role] {
+					seen[role] = true
+					next = append(next, role)
+				}
+			}
+		}
+		frontier = next
+	}
+	return false, nil
+}
+
+// GetRoles returns the roles name inherits directly.
+func (rm *RoleManager) GetRoles(name string, domain ...string) ([]string, error) {
+	d, err := roleDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := rm.links(true, name, d)
+	return append([]string(nil), roles...), err
+}
+
+// GetUsers returns the users and roles inheriting name directly.
+func (rm *RoleManager) GetUsers(name string, domain ...string) ([]string, error) {
+	d, err := roleDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	users, err := rm.links(false, name, d)
+	return append([]string(nil), users...), err
+}
+
+// PrintRoles logs the cached links. The links that aren't cached are only
+// stored in the database, so they aren't logged.
+func (rm *RoleManager) PrintRoles() error {
+	rm.mu.Lock()
+	logger := rm.logger
+	if !logger.IsEnabled() {
+		rm.mu.Unlock()
+		return nil
+	}
+	var roles []string
+	for e := rm.lru.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*roleEntry)
+		parts := strings.SplitN(entry.key, "\x00", 3)
+		if parts[0] != "roles" {
+			continue
+		}
+		for _, name := range entry.names {
+			roles = append(roles, fmt.Sprintf("%s < %s", parts[1], name))
+		}
+	}
+	rm.mu.Unlock()
+
+	sort.Strings(roles)
+	logger.LogRole(log.LogTypePrintRole, strings.Join(roles, ", "), roles)
+	return nil
+}
+
+// SetLogger sets the logger used by PrintRoles.
+func (rm *RoleManager) SetLogger(logger log.Logger) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	rm.logger = logger
+}
+
+// roleKey returns the cache key of the direct roles of name, or of its direct
+// users.
+func roleKey(roles bool, name string, domain string) string {
+	kind := "users"
+	if roles {
+		kind = "roles"
+	}
+	return kind + "\x00" + name + "\x00" + domain
+}
+
+// links returns the direct roles of name, or its direct users, from the cache
+// or the database. The returned slice must not be modified.
+func (rm *RoleManager) links(roles bool, name string, domain string) ([]string, error) {
+	key := roleKey(roles, name, domain)
+
+	rm.mu.Lock()
+	if e, ok := rm.entries[key]; ok {
+		rm.lru.MoveToFront(e)
+		rm.mu.Unlock()
+		return e.Value.(*roleEntry).names, nil
+	}
+	gen := rm.gen
+	rm.mu.Unlock()
+
+	names, err := rm.find(roles, name, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	// Links read before a change are not cached.
+	if gen == rm.gen {
+		if e, ok := rm.entries[key]; ok {
+			rm.remove(e)
+		}
+		rm.entries[key] = rm.lru.PushFront(&roleEntry{key: key, names: names})
+		for rm.maxEntries > 0 && len(rm.entries) > rm.maxEntries {
+			rm.remove(rm.lru.Back())
+		}
+	}
+	return names, nil
+}
+
+// remove drops a single entry. The caller must hold the lock.
+func (rm *RoleManager) remove(e *list.Element) {
+	entry := rm.lru.Remove(e).(*roleEntry)
+	delete(rm.entries, entry.key)
+}
+
+// find reads the direct roles of name, or its direct users, from the
+// database. Rules without a domain only match calls without a domain.
+func (rm *RoleManager) find(roles bool, name string, domain string) ([]string, error) {
+	a := rm.a
+	from := "v0"
+	if !roles {
+		from = "v1"
+	}
+	filter := bson.D{
+		{Key: "sec", Value: sectionSelector("g", rm.ptype)},
+		{Key: "ptype", Value: rm.ptype},
+		{Key: from, Value: a.cipher.encrypt(from, name)},
+		{Key: "v2", Value: a.cipher.encrypt("v2", domain)},
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), a.timeout)
+	defer cancel()
+
+	cursor, err := a.collectionFor("g", rm.ptype).Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	names := []string{}
+	for cursor.Next(ctx) {
+		var line CasbinRule
+		if err := cursor.Decode(&line); err != nil {
+			return nil, err
+		}
+		if line, err = a.cipher.decryptLine(line); err != nil {
+			return nil, err
+		}
+		if roles {
+			names = append(names, line.V1)
+		} else {
+			names = append(names, line.V0)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
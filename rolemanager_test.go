@@ -0,0 +1,126 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRoleManager(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	rm, err := NewRoleManager(a, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The enforcer holds the p rules only.
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetRoleManager(rm)
+	if err := e.LoadFilteredPolicy(bson.M{"ptype": bson.M{"$regex": "^p"}}); err != nil {
+		t.Fatal(err)
+	}
+	if roles := e.GetGroupingPolicy(); len(roles) != 0 {
+		t.Errorf("Grouping policy: %v, supposed to be empty", roles)
+	}
+	if ok, err := e.Enforce("alice", "data2", "read"); !ok || err != nil {
+		t.Errorf("Expected alice to read data2 through her role; got %v, %v", ok, err)
+	}
+	if ok, _ := e.Enforce("bob", "data2", "read"); ok {
+		t.Error("Expected bob not to read data2")
+	}
+
+	// Links added through the enforcer are stored and seen at once.
+	if _, err := e.AddGroupingPolicy("bob", "data2_admin"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := e.Enforce("bob", "data2", "read"); !ok {
+		t.Error("Expected bob to read data2 once he has the role")
+	}
+	if _, err := e.RemoveGroupingPolicy("bob", "data2_admin"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := e.Enforce("bob", "data2", "read"); ok {
+		t.Error("Expected bob not to read data2 once his role is removed")
+	}
+
+	// Links are followed transitively, within a domain.
+	for _, rule := range [][]string{
+		{"data2_admin", "admin"},
+		{"carol", "editor", "domain1"},
+		{"editor", "viewer", "domain1"},
+	} {
+		if err := a.AddPolicy("g", "g", rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm.Clear()
+	for _, test := range []struct {
+		name1, name2 string
+		domain       []string
+		expected     bool
+	}{
+		{"alice", "admin", nil, true},
+		{"admin", "alice", nil, false},
+		{"carol", "viewer", []string{"domain1"}, true},
+		{"carol", "viewer", []string{"domain2"}, false},
+		{"carol", "viewer", nil, false},
+	} {
+		if ok, err := rm.HasLink(test.name1, test.name2, test.domain...); ok != test.expected || err != nil {
+			t.Errorf("HasLink(%s, %s, %v): %v, %v, supposed to be %v", test.name1, test.name2, test.domain, ok, err, test.expected)
+		}
+	}
+	if _, err := rm.HasLink("carol", "viewer", "domain1", "domain2"); err == nil {
+		t.Error("Expected HasLink() with two domains to fail")
+	}
+
+	roles, err := rm.GetRoles("carol", "domain1")
+	if err != nil || fmt.Sprint(roles) != "[editor]" {
+		t.Errorf("Roles: %v, %v, supposed to be [editor]", roles, err)
+	}
+	users, err := rm.GetUsers("data2_admin")
+	if err != nil || fmt.Sprint(users) != "[alice]" {
+		t.Errorf("Users: %v, %v, supposed to be [alice]", users, err)
+	}
+	if n := len(rm.entries); n > 2 {
+		t.Errorf("Expected at most 2 cached entries; got %d", n)
+	}
+
+	// Changes made elsewhere are seen once the cache is cleared.
+	if roles, _ := rm.GetRoles("data2_admin"); fmt.Sprint(roles) != "[admin]" {
+		t.Errorf("Roles: %v, supposed to be [admin]", roles)
+	}
+	if err := a.RemovePolicy("g", "g", []string{"data2_admin", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := rm.GetRoles("data2_admin"); fmt.Sprint(roles) != "[admin]" {
+		t.Errorf("Roles: %v, supposed to be served from the cache", roles)
+	}
+	rm.Clear()
+	if ok, _ := rm.HasLink("alice", "admin"); ok {
+		t.Error("Expected the removed link to be gone once the cache is cleared")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultStatsTop is the default number of subjects and roles ranked by Stats.
+const defaultStatsTop = 10
+
+// defaultStatsValues is the default number of values counted by Stats at each
+// position.
+const defaultStatsValues = 100
+
+// ValueCount is the number of rules holding a value.
+type ValueCount struct {
+	Value string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// PolicyStats summarizes the stored rules matching a filter.
+type PolicyStats struct {
+	// Total is the number of rules.
+	Total int
+	// PTypes is the number of rules of each ptype.
+	PTypes map[string]int
+	// Values is the number of rules holding each of the most frequent values,
+	// by position: Values[0] counts the values of v0. At most the number of
+	// values set by WithStatsValues are counted at each position. Unused
+	// positions are not counted.
+	Values [6]map[string]int
+	// TopSubjects are the subjects (v0 of policy rules) with the most rules,
+	// in decreasing order.
+	TopSubjects []ValueCount
+	// TopRoles are the roles (v1 of grouping rules) with the most members, in
+	// decreasing order.
+	TopRoles []ValueCount
+}
+
+// StatsAdapter is the interface for adapters that can summarize the stored
+// policy without loading it.
+type StatsAdapter interface {
+	persist.Adapter
+	// Stats returns statistics about the stored rules matching filter, which
+	// is a MongoDB selector like the filters of LoadFilteredPolicy, or nil for
+	// all rules.
+	Stats(ctx context.Context, filter interface{}) (PolicyStats, error)
+}
+
+// Stats computes statistics about the stored rules matching filter on the
+// server. For each rule collection, one aggregation computes the ptype counts
+// and the rankings, and one per value position streams the counts of its most
+// frequent values.
+func (a *adapter) Stats(ctx context.Context, filter interface{}) (PolicyStats, error) {
+	stats := PolicyStats{PTypes: make(map[string]int)}
+
+	if filter == nil {
+		filter = bson.D{}
+	}
+	filter, err := a.encryptFilter(filter)
+	if err != nil {
+		return stats, err
+	}
+
+	facets := bson.D{
+		{Key: "ptypes", Value: countBy("ptype", nil)},
+		{Key: "subjects", Value: topBy("v0", sectionFilter("p"), a.statsTop)},
+		{Key: "roles", Value: topBy("v1", sectionFilter("g"), a.statsTop)},
+	}
+
+	var values [len(stats.Values)][]ValueCount
+	var subjects, roles []ValueCount
+	for _, coll := range a.collections {
+		result, err := a.aggregateStats(ctx, coll, filter, facets)
+		if err != nil {
+			return stats, err
+		}
+
+		for _, c := range result["ptypes"] {
+			stats.PTypes[c.Value] += c.Count
+			stats.Total += c.Count
+		}
+		for i := range values {
+			err := a.countValues(ctx, coll, filter, fmt.Sprintf("v%d", i), func(c ValueCount) error {
+				values[i] = append(values[i], c)
+				return nil
+			})
+			if err != nil {
+				return stats, err
+			}
+		}
+		subjects = append(subjects, result["subjects"]...)
+		roles = append(roles, result["roles"]...)
+	}
+
+	for i := range values {
+		field := fmt.Sprintf("v%d", i)
+		counts, err := a.decryptCounts(field, topCounts(values[i], a.statsValues))
+		if err != nil {
+			return stats, err
+		}
+		stats.Values[i] = make(map[string]int, len(counts))
+		for _, c := range counts {
+			stats.Values[i][c.Value] = c.Count
+		}
+	}
+	if stats.TopSubjects, err = a.decryptCounts("v0", topCounts(subjects, a.statsTop)); err != nil {
+		return stats, err
+	}
+	if stats.TopRoles, err = a.decryptCounts("v1", topCounts(roles, a.statsTop)); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// countValues calls fn with the number of rules of coll matching filter
+// holding each of the most frequent non-empty values of field, in decreasing
+// order. The counts are read from a cursor rather than gathered in a single
+// result document, which is size-limited.
+func (a *adapter) countValues(ctx context.Context, coll store.Collection, filter interface{}, field string,
+	fn func(c ValueCount) error) error {
+
+	pipeline := append(bson.A{bson.D{{Key: "$match", Value: filter}}}, topBy(field, bson.D{
+		{Key: field, Value: bson.M{"$nin": bson.A{"", nil}}},
+	}, a.statsValues)...)
+	cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var c ValueCount
+		if err := cursor.Decode(&c); err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// aggregateStats runs the statistics facets on the rules of coll matching
+// filter. The facets hold the counts of the ptypes and the rankings, which
+// are bounded.
+func (a *adapter) aggregateStats(ctx context.Context, coll store.Collection, filter interface{},
+	facets bson.D) (map[string][]ValueCount, error) {
+
+	cursor, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$facet", Value: facets}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var result map[string][]ValueCount
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&result); err != nil {
+			return nil, err
+		}
+	}
+	return result, cursor.Err()
+}
+
+// topCounts merges the rankings of several collections and keeps the n most
+// frequent values. The rankings are exact when each value is counted in a
+// single collection, which is the case unless the rules of a section are
+// split across collections by ptype.
+func topCounts(counts []ValueCount, n int) []ValueCount {
+	merged := make(map[string]int)
+	var values []string
+	for _, c := range counts {
+		if _, ok := merged[c.Value]; !ok {
+			values = append(values, c.Value)
+		}
+		merged[c.Value] += c.Count
+	}
+
+	top := make([]ValueCount, 0, len(values))
+	for _, v := range values {
+		top = append(top, ValueCount{Value: v, Count: merged[v]})
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Value < top[j].Value
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (a *adapter) decryptCounts(field string, counts []ValueCount) ([]ValueCount, error) {
+	var err error
+	for i := range counts {
+		if counts[i].Value, err = a.cipher.decrypt(field, counts[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// countBy returns the facet counting the rules matching selector by the value
+// of field.
+func countBy(field string, selector bson.D) bson.A {
+	var stages bson.A
+	if selector != nil {
+		stages = append(stages, bson.D{{Key: "$match", Value: selector}})
+	}
+	return append(stages, bson.D{{Key: "$group", Value: bson.D{
+		{Key: "_id", Value: "$" + field},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+	}}})
+}
+
+// topBy returns the facet ranking the n most frequent values of field among
+// the rules matching selector.
+func topBy(field string, selector bson.D, n int) bson.A {
+	return append(countBy(field, selector),
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: n}},
+	)
+}
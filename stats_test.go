@@ -0,0 +1,90 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAdapter_Stats(t *testing.T) {
+	db := memory.NewDatabase()
+	a, err := NewAdapterWithDatabase(db, WithEncryption(testKey, 0), WithStatsTop(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma := a.(*adapter)
+	setup(ma, []interface{}{
+		ma.cipher.encryptLine(CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data1", V2: "read"}),
+		ma.cipher.encryptLine(CasbinRule{Sec: "p", PType: "p", V0: "bob", V1: "data2", V2: "write"}),
+		ma.cipher.encryptLine(CasbinRule{Sec: "p", PType: "p", V0: "data2_admin", V1: "data2", V2: "read"}),
+		ma.cipher.encryptLine(CasbinRule{Sec: "p", PType: "p", V0: "data2_admin", V1: "data2", V2: "write"}),
+		ma.cipher.encryptLine(CasbinRule{Sec: "g", PType: "g", V0: "alice", V1: "data2_admin"}),
+		// Rules written before sections were stored.
+		ma.cipher.encryptLine(CasbinRule{PType: "g", V0: "bob", V1: "data2_admin"}),
+		ma.cipher.encryptLine(CasbinRule{PType: "g", V0: "carol", V1: "data1_admin"}),
+	})
+
+	stats, err := a.(StatsAdapter).Stats(context.TODO(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 7 {
+		t.Errorf("Total: %d, supposed to be 7", stats.Total)
+	}
+	if expected := map[string]int{"p": 4, "g": 3}; !reflect.DeepEqual(stats.PTypes, expected) {
+		t.Errorf("PTypes: %v, supposed to be %v", stats.PTypes, expected)
+	}
+	if expected := map[string]int{"alice": 2, "bob": 2, "data2_admin": 2, "carol": 1}; !reflect.DeepEqual(stats.Values[0], expected) {
+		t.Errorf("Values[0]: %v, supposed to be %v", stats.Values[0], expected)
+	}
+	if expected := map[string]int{"read": 2, "write": 2}; !reflect.DeepEqual(stats.Values[2], expected) {
+		t.Errorf("Values[2]: %v, supposed to be %v", stats.Values[2], expected)
+	}
+	if len(stats.Values[3]) != 0 {
+		t.Errorf("Expected unused positions not to be counted; got %v", stats.Values[3])
+	}
+	// Ties are ordered by stored value, which is encrypted here.
+	if len(stats.TopSubjects) != 2 || stats.TopSubjects[0] != (ValueCount{"data2_admin", 2}) {
+		t.Errorf("TopSubjects: %v, supposed to start with data2_admin", stats.TopSubjects)
+	}
+	if expected := []ValueCount{{"data2_admin", 2}, {"data1_admin", 1}}; !reflect.DeepEqual(stats.TopRoles, expected) {
+		t.Errorf("TopRoles: %v, supposed to be %v", stats.TopRoles, expected)
+	}
+
+	stats, err = a.(StatsAdapter).Stats(context.TODO(), bson.M{"v0": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"p": 1, "g": 1}; stats.Total != 2 || !reflect.DeepEqual(stats.PTypes, expected) {
+		t.Errorf("PTypes: %v, supposed to be %v", stats.PTypes, expected)
+	}
+
+	// Only the most frequent values are counted.
+	capped, err := NewAdapterWithDatabase(db, WithEncryption(testKey, 0), WithStatsValues(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = capped.(StatsAdapter).Stats(context.TODO(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"data2": 3}; !reflect.DeepEqual(stats.Values[1], expected) {
+		t.Errorf("Values[1]: %v, supposed to be %v", stats.Values[1], expected)
+	}
+}
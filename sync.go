@@ -0,0 +1,250 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultSyncInterval is the default delay between two syncs from a source
+	// that can't be watched.
+	defaultSyncInterval = time.Minute
+	// syncDebounce is the delay during which change events are collected into
+	// a single sync.
+	syncDebounce = 100 * time.Millisecond
+	// syncRetryDelay is the delay before the first retry of a failed sync. It
+	// doubles with every failure in a row, up to maxSyncRetryDelay.
+	syncRetryDelay    = time.Second
+	maxSyncRetryDelay = time.Minute
+)
+
+// SyncOption configures Sync.
+type SyncOption func(*syncer) error
+
+// syncer copies the policy of an adapter to another one.
+type syncer struct {
+	model      model.Model
+	continuous bool
+	interval   time.Duration
+	onError    func(error)
+}
+
+// WithSyncModel sets the model defining the ptypes to copy. It is required
+// unless the source is an adapter of this package, whose stored ptypes are
+// copied by default. The rules an adapter of this package stores for other
+// ptypes are skipped.
+func WithSyncModel(m model.Model) SyncOption {
+	return func(s *syncer) error {
+		s.model = m
+		return nil
+	}
+}
+
+// WithContinuousSync makes Sync keep the destination up to date until its
+// context is done. Changes to a source of this package are picked up from
+// change streams; other sources, and deployments without change streams, are
+// synced every interval, or every minute if interval is zero.
+func WithContinuousSync(interval time.Duration) SyncOption {
+	return func(s *syncer) error {
+		if interval < 0 {
+			return errors.New("sync interval must be positive")
+		}
+		s.continuous = true
+		if interval > 0 {
+			s.interval = interval
+		}
+		return nil
+	}
+}
+
+// WithSyncErrorHandler sets a function called with the errors of the syncs
+// made by WithContinuousSync, which are otherwise ignored.
+func WithSyncErrorHandler(fn func(error)) SyncOption {
+	return func(s *syncer) error {
+		s.onError = fn
+		return nil
+	}
+}
+
+// Sync copies the policy of src to dst, replacing the policy of dst. When dst
+// is an adapter of this package, only the rules that differ are written;
+// other destinations are saved in full. The reads and writes of the adapters
+// of this package stop when ctx is done. With WithContinuousSync, Sync keeps
+// copying changes until ctx is done and then returns ctx.Err(); a failed sync
+// is retried after a delay that grows with every failure in a row.
+func Sync(ctx context.Context, src, dst persist.Adapter, opts ...SyncOption) error {
+	s := &syncer{interval: defaultSyncInterval}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return err
+		}
+	}
+	if _, ok := src.(*adapter); !ok && s.model == nil {
+		return errors.New("syncing from another adapter needs WithSyncModel")
+	}
+
+	if !s.continuous {
+		return s.sync(ctx, src, dst)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var changed <-chan struct{}
+	if a, ok := src.(*adapter); ok {
+		// Streams are opened before the first sync, so no change is missed.
+		changed = watchChanges(ctx, a.collections)
+	}
+	return s.run(ctx, src, dst, changed)
+}
+
+// run syncs once, then again on every notification from changed, or every
+// interval if changed is nil, until ctx is done. Failed syncs are reported
+// and retried.
+func (s *syncer) run(ctx context.Context, src, dst persist.Adapter, changed <-chan struct{}) error {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	tick := ticker.C
+	if changed != nil {
+		tick = nil
+	}
+
+	retry := syncRetryDelay
+	for {
+		if err := s.sync(ctx, src, dst); err != nil {
+			if s.onError != nil {
+				s.onError(err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > maxSyncRetryDelay {
+				retry = maxSyncRetryDelay
+			}
+			continue
+		}
+		retry = syncRetryDelay
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+		case <-changed:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(syncDebounce):
+			}
+			select {
+			case <-changed:
+			default:
+			}
+		}
+	}
+}
+
+// sync copies the policy of src to dst once. Other adapters than those of
+// this package don't take a context, so ctx is only checked before they are
+// called.
+func (s *syncer) sync(ctx context.Context, src, dst persist.Adapter) error {
+	m, err := s.load(ctx, src)
+	if err != nil {
+		return err
+	}
+	if a, ok := dst.(*adapter); ok {
+		_, err = a.saveDiff(ctx, m, nil)
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return dst.SavePolicy(m)
+}
+
+// load loads the policy of src into a new model. The rules of an adapter of
+// this package are read directly, so that the filter and state of the
+// adapter are left untouched.
+func (s *syncer) load(ctx context.Context, src persist.Adapter) (model.Model, error) {
+	m := model.NewModel()
+	if s.model != nil {
+		for _, sec := range []string{"p", "g"} {
+			for ptype, ast := range s.model[sec] {
+				m.AddDef(sec, ptype, ast.Value)
+			}
+		}
+	}
+
+	a, ok := src.(*adapter)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return m, err
+		}
+		return m, src.LoadPolicy(m)
+	}
+	return m, a.forEachLine(ctx, nil, func(line CasbinRule) error {
+		sec := section(line)
+		if _, ok := m[sec][line.PType]; !ok {
+			if s.model != nil {
+				return nil
+			}
+			m.AddDef(sec, line.PType, "_")
+		}
+		return loadPolicyLine(line, m)
+	})
+}
+
+// watchChanges returns a channel notified of the changes to colls until ctx
+// is done, or nil if change streams aren't supported.
+func watchChanges(ctx context.Context, colls []store.Collection) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	streams := make([]store.ChangeStream, 0, len(colls))
+	for _, coll := range colls {
+		stream, err := coll.Watch(ctx, mongo.Pipeline{})
+		if err != nil {
+			for _, s := range streams {
+				s.Close(context.Background())
+			}
+			return nil
+		}
+		streams = append(streams, stream)
+	}
+
+	for i, stream := range streams {
+		// Changes may be missed until a new stream is open, so the policy is
+		// synced again once it is.
+		go followChanges(ctx, colls[i], stream, notify, func(open bool) {
+			if open {
+				notify()
+			}
+		})
+	}
+	return changed
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+)
+
+func TestSync(t *testing.T) {
+	src, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(src.(*adapter))
+	setup(dst.(*adapter), []interface{}{
+		CasbinRule{Sec: "p", PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{Sec: "p", PType: "p", V0: "carol", V1: "data3", V2: "read"},
+	})
+	aliceID := func() interface{} {
+		t.Helper()
+		res, err := dst.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{PType: "p", Values: [6]*ValueMatch{0: {Value: "alice"}}}, Page{})
+		if err != nil || len(res.Rules) != 1 {
+			t.Fatalf("Expected to find alice's rule; got %v, %v", res.Rules, err)
+		}
+		return res.Rules[0].ID
+	}
+	kept := aliceID()
+
+	// Only the difference is written to an adapter of this package.
+	if err := Sync(context.TODO(), src, dst); err != nil {
+		t.Fatal(err)
+	}
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if id := aliceID(); id != kept {
+		t.Errorf("Expected the unchanged rule to keep its ID %v; got %v", kept, id)
+	}
+
+	// Other adapters are saved in full, and need a model as sources.
+	dir, err := ioutil.TempDir("", "casbin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := fileadapter.NewAdapter(filepath.Join(dir, "policy.csv"))
+	if err := Sync(context.TODO(), src, file); err != nil {
+		t.Fatal(err)
+	}
+	e, err = casbin.NewEnforcer("examples/rbac_model.conf", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	file = fileadapter.NewAdapter("examples/rbac_policy.csv")
+	if err := Sync(context.TODO(), file, dst); err == nil {
+		t.Error("Expected Sync() from a file without a model to fail")
+	}
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Sync(context.TODO(), file, dst, WithSyncModel(m)); err != nil {
+		t.Fatal(err)
+	}
+	e, err = casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if len(m.GetPolicy("p", "p")) != 0 {
+		t.Error("Expected the model given to Sync() to be left empty")
+	}
+
+	// A one-shot sync stops when its context is done.
+	if err := src.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Sync(ctx, src, dst); err != context.Canceled {
+		t.Errorf("Expected Sync() to return context.Canceled; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if e.HasPolicy("carol", "data3", "read") {
+		t.Error("Expected a canceled sync to leave the destination unchanged")
+	}
+}
+
+func TestSync_Continuous(t *testing.T) {
+	src, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(src.(*adapter))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Sync(ctx, src, dst, WithContinuousSync(time.Hour))
+	}()
+
+	e, err := casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPolicy := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+			if err := e.LoadPolicy(); err != nil {
+				t.Fatal(err)
+			}
+			if len(e.GetPolicy()) == n {
+				return
+			}
+		}
+		t.Fatalf("Policy: %v, supposed to have %d rules", e.GetPolicy(), n)
+	}
+
+	waitForPolicy(4)
+	// The change is picked up from the change stream, not the hourly poll.
+	if err := src.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForPolicy(5)
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected Sync() to return context.Canceled; got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+// ErrInvalidRule is returned, wrapped with the reason, when validation is
+// enabled and a rule doesn't match the model.
+var ErrInvalidRule = errors.New("invalid rule")
+
+// validateRule checks rule against the validation model, if one is set.
+func (a *adapter) validateRule(sec string, ptype string, rule []string) error {
+	if a.validation == nil {
+		return nil
+	}
+
+	ast, ok := a.validation[sec][ptype]
+	if !ok {
+		return fmt.Errorf("%w: ptype %q is not defined in section %q of the model", ErrInvalidRule, ptype, sec)
+	}
+
+	// Policy definitions list their tokens, role definitions have one "_"
+	// per value.
+	expected := len(ast.Tokens)
+	if sec == "g" {
+		expected = strings.Count(ast.Value, "_")
+	}
+	if len(rule) != expected {
+		return fmt.Errorf("%w: %s rule %v has %d values, the model defines %d (%s)",
+			ErrInvalidRule, ptype, rule, len(rule), expected, ast.Value)
+	}
+
+	return nil
+}
+
+// validateModel checks every rule of m against the validation model.
+func (a *adapter) validateModel(m model.Model) error {
+	if a.validation == nil {
+		return nil
+	}
+
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				if err := a.validateRule(sec, ptype, rule); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+	"github.com/casbin/casbin/v2/model"
+)
+
+func TestAdapter_Validation(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAdapterWithDatabase(memory.NewDatabase(), WithValidation(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sec   string
+		ptype string
+		rule  []string
+		valid bool
+	}{
+		{"p", "p", []string{"alice", "data1", "read"}, true},
+		{"g", "g", []string{"alice", "admin"}, true},
+		{"p", "p2", []string{"alice", "data1", "read"}, false},
+		{"g", "p", []string{"alice", "data1", "read"}, false},
+		{"p", "p", []string{"alice", "data1"}, false},
+		{"g", "g", []string{"alice", "admin", "domain1"}, false},
+	}
+	for _, tt := range tests {
+		err := a.AddPolicy(tt.sec, tt.ptype, tt.rule)
+		if tt.valid && err != nil {
+			t.Errorf("Expected AddPolicy(%s, %s, %v) to be successful; got %v", tt.sec, tt.ptype, tt.rule, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("Expected AddPolicy(%s, %s, %v) to fail with ErrInvalidRule; got %v", tt.sec, tt.ptype, tt.rule, err)
+		}
+	}
+
+	// SavePolicy rejects a model holding an invalid rule before writing anything.
+	saved, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved.AddPolicy("p", "p", []string{"bob", "data2"})
+	if err := a.SavePolicy(saved); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("Expected SavePolicy() to fail with ErrInvalidRule; got %v", err)
+	}
+	loaded, _ := model.NewModelFromFile("examples/rbac_model.conf")
+	if err := a.LoadPolicy(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.GetPolicy("p", "p")) != 1 || len(loaded.GetPolicy("g", "g")) != 1 {
+		t.Errorf("Expected the stored policy to be untouched; got %v, %v", loaded.GetPolicy("p", "p"), loaded.GetPolicy("g", "g"))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/internal/store"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ConflictError is returned by UpdateRule when the rule changed since it was
+// read.
+type ConflictError struct {
+	// ID is the document ID of the rule.
+	ID interface{}
+	// Expected is the version the update was based on.
+	Expected int64
+	// Actual is the current version of the rule, or -1 if it was removed.
+	Actual int64
+}
+
+func (e *ConflictError) Error() string {
+	if e.Actual < 0 {
+		return fmt.Sprintf("rule %v was removed", e.ID)
+	}
+	return fmt.Sprintf("rule %v is at version %d, expected version %d", e.ID, e.Actual, e.Expected)
+}
+
+// VersionedAdapter is the interface for adapters supporting optimistic
+// concurrency control on rule updates.
+type VersionedAdapter interface {
+	persist.Adapter
+	// UpdateRule replaces the values of a stored rule, as returned by
+	// FindPolicies, with newRule. It fails with a *ConflictError if the rule
+	// was updated or removed since it was read.
+	UpdateRule(ctx context.Context, line CasbinRule, newRule []string) (CasbinRule, error)
+}
+
+// ruleUpdate returns the update setting the values of a rule to those of line
+// and incrementing its version.
+func ruleUpdate(line CasbinRule) bson.D {
+	return bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "sec", Value: line.Sec},
+			{Key: "ptype", Value: line.PType},
+			{Key: "v0", Value: line.V0},
+			{Key: "v1", Value: line.V1},
+			{Key: "v2", Value: line.V2},
+			{Key: "v3", Value: line.V3},
+			{Key: "v4", Value: line.V4},
+			{Key: "v5", Value: line.V5},
+			{Key: "arity", Value: line.Arity},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: int64(1)}}},
+	}
+}
+
+// versionSelector returns the selector value matching version. Rules that were
+// never updated have no version field.
+func versionSelector(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{int64(0), nil}}
+	}
+	return version
+}
+
+// UpdateRule replaces the values of the stored rule line with newRule if the
+// rule is still at line.Version, and returns the updated rule.
+func (a *adapter) UpdateRule(ctx context.Context, line CasbinRule, newRule []string) (CasbinRule, error) {
+	if line.ID == nil {
+		return CasbinRule{}, errors.New("the rule has no document ID")
+	}
+	sec := section(line)
+	if err := a.validateRule(sec, line.PType, newRule); err != nil {
+		return CasbinRule{}, err
+	}
+	update := a.newLine(sec, line.PType, newRule)
+	coll := a.collectionFor(sec, line.PType)
+	defer a.cache.Invalidate()
+
+	filter := bson.D{
+		{Key: "_id", Value: line.ID},
+		{Key: "version", Value: versionSelector(line.Version)},
+	}
+	if a.ruleIDs {
+		// The rule is replaced by a document with the ID of its new values.
+		update.Version = line.Version + 1
+		replaced, err := a.replaceRule(ctx, sec, line.PType, filter, update)
+		if err != nil {
+			return CasbinRule{}, err
+		}
+		if replaced {
+			return a.cipher.decryptLine(update)
+		}
+		return CasbinRule{}, a.conflict(ctx, coll, line)
+	}
+
+	var updated CasbinRule
+	err := coll.FindOneAndUpdate(ctx, filter, ruleUpdate(update),
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&updated)
+	if err == nil {
+		return a.cipher.decryptLine(updated)
+	}
+	if err != mongo.ErrNoDocuments {
+		return CasbinRule{}, err
+	}
+	return CasbinRule{}, a.conflict(ctx, coll, line)
+}
+
+// conflict returns the error reporting that line changed since it was read.
+func (a *adapter) conflict(ctx context.Context, coll store.Collection, line CasbinRule) error {
+	conflict := &ConflictError{ID: line.ID, Expected: line.Version, Actual: -1}
+	var current CasbinRule
+	err := coll.FindOne(ctx, bson.D{{Key: "_id", Value: line.ID}}).Decode(&current)
+	switch err {
+	case nil:
+		conflict.Actual = current.Version
+	case mongo.ErrNoDocuments:
+	default:
+		return err
+	}
+	return conflict
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Southbank Software Pty Ltd. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/SouthbankSoftware/casbin-mongodb-adapter/v3/memory"
+)
+
+func TestAdapter_UpdateRule(t *testing.T) {
+	a, err := NewAdapterWithDatabase(memory.NewDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRBAC(a.(*adapter))
+	va := a.(VersionedAdapter)
+
+	res, err := a.(QueryAdapter).FindPolicies(context.TODO(), PolicyQuery{
+		Values: [6]*ValueMatch{0: {Value: "alice"}, 1: {Value: "data1"}},
+	}, Page{})
+	if err != nil || len(res.Rules) != 1 {
+		t.Fatalf("Expected to find alice's rule; got %v, %v", res.Rules, err)
+	}
+	read := res.Rules[0]
+
+	// Two admins edit the same rule; the first one wins.
+	updated, err := va.UpdateRule(context.TODO(), read, []string{"alice", "data1", "write"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != read.ID || updated.Version != 1 || updated.V2 != "write" {
+		t.Errorf("Updated rule: %+v, supposed to be at version 1", updated)
+	}
+
+	_, err = va.UpdateRule(context.TODO(), read, []string{"alice", "data1", "delete"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Expected != 0 || conflict.Actual != 1 {
+		t.Fatalf("Expected a conflict with version 1; got %v", err)
+	}
+
+	if updated, err = va.UpdateRule(context.TODO(), updated, []string{"alice", "data1", "delete"}); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("Version: %d, supposed to be 2", updated.Version)
+	}
+
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "delete"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = va.UpdateRule(context.TODO(), updated, []string{"alice", "data1", "read"})
+	if !errors.As(err, &conflict) || conflict.Actual != -1 {
+		t.Errorf("Expected a conflict for a removed rule; got %v", err)
+	}
+}